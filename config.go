@@ -16,6 +16,8 @@ type Config struct {
 	LLM     llm.Config         `toml:"llm"`
 	Bot     core.BotConfig     `toml:"bot"`
 	Credits core.CreditsConfig `toml:"credits"`
+	Rooms   core.RoomsConfig   `toml:"rooms"`
+	Audit   core.AuditConfig   `toml:"audit"`
 }
 
 func LoadConfig(path string) (*Config, error) {
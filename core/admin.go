@@ -0,0 +1,219 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registerAdminCommands(b *Bot) {
+	b.Commands.Register("audit", AdminOnly(auditCommand))
+	b.Commands.Register("quota", AdminOnly(quotaCommand))
+}
+
+// AdminOnly wraps a command so that only users in `admins` can run it.
+func AdminOnly(handler CommandHandler) CommandHandler {
+	return func(ctx CommandContext) error {
+		if !ctx.Bot.Config.IsAdmin(ctx.Msg.UserID) {
+			return ctx.Reply("⛔ This command is restricted to bot admins.")
+		}
+		return handler(ctx)
+	}
+}
+
+// parseAuditFilter reads `key value` pairs such as `since 24h user @a:b`.
+func parseAuditFilter(args []string, defaultLimit int) (AuditFilter, error) {
+	filter := AuditFilter{Limit: defaultLimit}
+	if len(args)%2 != 0 {
+		return filter, fmt.Errorf("options must be `key value` pairs")
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		key, value := strings.ToLower(args[i]), args[i+1]
+		switch key {
+		case "since":
+			d, err := parseLongDuration(value)
+			if err != nil {
+				return filter, err
+			}
+			filter.Since = time.Now().Add(-d)
+		case "user":
+			filter.UserID = value
+		case "room":
+			filter.ChatID = value
+		case "kind":
+			filter.Kind = strings.ToLower(value)
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("invalid limit `%s`", value)
+			}
+			filter.Limit = n
+		default:
+			return filter, fmt.Errorf("unknown option `%s`", key)
+		}
+	}
+	return filter, nil
+}
+
+// parseLongDuration accepts time.ParseDuration values plus whole days, e.g. `7d`.
+func parseLongDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration `%s`", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration `%s`", value)
+	}
+	return d, nil
+}
+
+func formatAuditEntry(e AuditEntry) string {
+	line := fmt.Sprintf("%s %s/%s %s", e.Time.Local().Format("2006-01-02 15:04"), e.Kind, e.Action, e.UserID)
+	if e.ChatID != "" {
+		line += " in " + e.ChatID
+	}
+	if e.Provider != "" {
+		line += fmt.Sprintf(" %s/%s", e.Provider, e.Model)
+	}
+	if e.Tokens > 0 {
+		line += fmt.Sprintf(" %d tok", e.Tokens)
+	}
+	line += " " + e.Status
+	if e.Detail != "" {
+		line += " (" + e.Detail + ")"
+	}
+	return line
+}
+
+func auditCommand(ctx CommandContext) error {
+	usage := "Usage: `audit [recent|top|export] [since 24h] [user <id>] [room <id>] [kind llm|admin] [limit <n>]`"
+	if !ctx.Bot.Audit.Enabled() {
+		return ctx.Reply("The audit log is disabled. Set `[audit] file_path` in the config.")
+	}
+
+	subcmd := "recent"
+	args := ctx.Args
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "recent", "top", "export":
+			subcmd = strings.ToLower(args[0])
+			args = args[1:]
+		}
+	}
+
+	defaultLimit := 20
+	if subcmd != "recent" {
+		defaultLimit = 0
+	}
+	filter, err := parseAuditFilter(args, defaultLimit)
+	if err != nil {
+		return ctx.Reply(err.Error() + "\n" + usage)
+	}
+	if subcmd == "top" {
+		filter.Kind = AuditKindLLM
+	}
+
+	entries, err := ctx.Bot.Audit.Query(filter)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return ctx.Reply("No matching audit entries.")
+	}
+
+	switch subcmd {
+	case "top":
+		tokens := map[string]int{}
+		requests := map[string]int{}
+		for _, e := range entries {
+			tokens[e.UserID] += e.Tokens
+			requests[e.UserID]++
+		}
+		users := make([]string, 0, len(tokens))
+		for user := range tokens {
+			users = append(users, user)
+		}
+		sort.Slice(users, func(i, j int) bool { return tokens[users[i]] > tokens[users[j]] })
+		if len(users) > 10 {
+			users = users[:10]
+		}
+
+		var sb strings.Builder
+		sb.WriteString("📊 **Top token users**\n")
+		for i, user := range users {
+			sb.WriteString(fmt.Sprintf("%d. %s: %d tokens in %d requests\n", i+1, user, tokens[user], requests[user]))
+		}
+		return ctx.Reply(sb.String())
+
+	case "export":
+		var sb strings.Builder
+		for _, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			sb.Write(data)
+			sb.WriteByte('\n')
+		}
+		return ctx.SendMedia(Attachment{
+			Name:     "audit-" + time.Now().UTC().Format("20060102-150405") + ".jsonl",
+			MimeType: "application/x-ndjson",
+			Data:     []byte(sb.String()),
+			Caption:  fmt.Sprintf("📄 %d audit entries", len(entries)),
+		})
+
+	default:
+		var sb strings.Builder
+		for _, e := range entries {
+			sb.WriteString(formatAuditEntry(e) + "\n")
+		}
+		return ctx.Reply("```\n" + sb.String() + "```")
+	}
+}
+
+func quotaCommand(ctx CommandContext) error {
+	if len(ctx.Args) < 1 {
+		return ctx.Reply("Usage: `quota <user> [grant <tokens>|reset]`")
+	}
+	userID := ctx.Args[0]
+	credits := ctx.Bot.UserCredits
+
+	if len(ctx.Args) == 1 {
+		tokens, hasKey := credits.GetUserStats(userID, ctx.Bot.LLM.ID())
+		resp := fmt.Sprintf("%s has used %d of %d tokens.", userID, tokens, credits.GetUserLimit(userID))
+		if hasKey {
+			resp += fmt.Sprintf(" They use their own %s key.", ctx.Bot.LLM.ID())
+		}
+		return ctx.Reply(resp)
+	}
+
+	switch strings.ToLower(ctx.Args[1]) {
+	case "grant":
+		if len(ctx.Args) != 3 {
+			return ctx.Reply("Usage: `quota <user> grant <tokens>`")
+		}
+		tokens, err := strconv.Atoi(ctx.Args[2])
+		if err != nil || tokens <= 0 {
+			return ctx.Reply("Tokens must be a positive number.")
+		}
+		credits.GrantTokens(userID, tokens)
+		ctx.Bot.auditAdmin(&ctx.Msg, "quota_grant", "ok", fmt.Sprintf("%s +%d", userID, tokens))
+		return ctx.Reply(fmt.Sprintf("✅ Granted %d tokens to %s. New limit: %d.", tokens, userID, credits.GetUserLimit(userID)))
+
+	case "reset":
+		credits.ResetUsage(userID)
+		ctx.Bot.auditAdmin(&ctx.Msg, "quota_reset", "ok", userID)
+		return ctx.Reply(fmt.Sprintf("✅ Usage for %s has been reset.", userID))
+
+	default:
+		return ctx.Reply("Unknown quota subcommand. Available: `grant`, `reset`")
+	}
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxAttachments is how many files of one message are passed on.
+	MaxAttachments = 10
+	// MaxAttachmentSize bounds a single file, MaxAttachmentsSize all of a
+	// message's files. Gemini rejects inline data over 20 MB per request,
+	// and base64 adds a third.
+	MaxAttachmentSize  = 10 * 1024 * 1024
+	MaxAttachmentsSize = 14 * 1024 * 1024
+)
+
+var (
+	ErrAttachmentTooLarge    = errors.New("attachment is too large")
+	ErrUnsupportedAttachment = errors.New("unsupported attachment type")
+)
+
+// SniffMimeType detects the type of data instead of trusting what the
+// sender declared, which is often missing or wrong. declared and the file
+// extension are only used when the content itself is inconclusive.
+func SniffMimeType(name string, declared string, data []byte) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	switch sniffed {
+	case "application/ogg":
+		// voice messages; video in Ogg is rare enough to ignore
+		return "audio/ogg"
+	case "video/mp4", "video/webm":
+		// the containers are shared with audio-only files like .m4a
+		if strings.HasPrefix(declared, "audio/") {
+			return declared
+		}
+	case "application/octet-stream", "":
+		if declared, _, err := mime.ParseMediaType(declared); err == nil && declared != "" {
+			return declared
+		}
+		if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name))); err == nil && byExt != "" {
+			return byExt
+		}
+		return "application/octet-stream"
+	}
+	return sniffed
+}
+
+// IsSupportedAttachment reports whether files of this type can be passed
+// to the model: images, PDFs, plain text and audio.
+func IsSupportedAttachment(mimeType string) bool {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"),
+		strings.HasPrefix(mimeType, "text/"),
+		strings.HasPrefix(mimeType, "audio/"),
+		mimeType == "application/pdf":
+		return true
+	default:
+		return false
+	}
+}
+
+// AddAttachment sniffs the type of a downloaded file and adds it to the
+// message if it is supported and within the size limits. att.MimeType is
+// the type the sender declared, if any.
+func (msg *IncomingMessage) AddAttachment(att Attachment) error {
+	if len(msg.Attachments) >= MaxAttachments {
+		return fmt.Errorf("%s: at most %d files are supported", att.Name, MaxAttachments)
+	}
+	if len(att.Data) > MaxAttachmentSize {
+		return fmt.Errorf("%s: %w, the limit is %d MB", att.Name, ErrAttachmentTooLarge, MaxAttachmentSize>>20)
+	}
+	total := len(att.Data)
+	for _, other := range msg.Attachments {
+		total += len(other.Data)
+	}
+	if total > MaxAttachmentsSize {
+		return fmt.Errorf("%s: %w, all files together may be %d MB", att.Name, ErrAttachmentTooLarge, MaxAttachmentsSize>>20)
+	}
+
+	att.MimeType = SniffMimeType(att.Name, att.MimeType, att.Data)
+	if !IsSupportedAttachment(att.MimeType) {
+		return fmt.Errorf("%s: %w (%s)", att.Name, ErrUnsupportedAttachment, att.MimeType)
+	}
+	msg.Attachments = append(msg.Attachments, att)
+	return nil
+}
+
+// fileKind names a type of file for messages to the user.
+func fileKind(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "images"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	case mimeType == "application/pdf":
+		return "PDFs"
+	default:
+		return mimeType + " files"
+	}
+}
+
+// attachmentProblem describes the files that couldn't be read, if any.
+func (msg *IncomingMessage) attachmentProblem() string {
+	if len(msg.AttachmentErrors) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("⚠️ I couldn't read the attached file")
+	if len(msg.AttachmentErrors) > 1 {
+		sb.WriteString("s")
+	}
+	sb.WriteString(":")
+	for _, err := range msg.AttachmentErrors {
+		sb.WriteString("\n- " + err.Error())
+	}
+	return sb.String()
+}
+
+// hasOnly reports whether all of the message's attachments are of the
+// given kind, e.g. "image/".
+func (msg *IncomingMessage) hasOnly(typePrefix string) bool {
+	for _, att := range msg.Attachments {
+		if !strings.HasPrefix(att.MimeType, typePrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// audioAttachments returns the message's audio files.
+func (msg *IncomingMessage) audioAttachments() []Attachment {
+	var audio []Attachment
+	for _, att := range msg.Attachments {
+		if strings.HasPrefix(att.MimeType, "audio/") {
+			audio = append(audio, att)
+		}
+	}
+	return audio
+}
+
+// assumedAudioBytesPerSecond estimates the length of audio from its size.
+// Voice messages are Opus at about 32 kbit/s, so music at higher bitrates
+// is overestimated rather than undercharged.
+const assumedAudioBytesPerSecond = 4000
+
+// audioDuration is the longer of the reported and the estimated length.
+// The reported one comes from the sender's client, so it can't be trusted
+// to be lower.
+func audioDuration(att Attachment) time.Duration {
+	estimated := time.Duration(len(att.Data)) * time.Second / assumedAudioBytesPerSecond
+	return max(att.Duration, estimated)
+}
+
+func totalAudioDuration(audio []Attachment) time.Duration {
+	var total time.Duration
+	for _, att := range audio {
+		total += audioDuration(att)
+	}
+	return total
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestSniffMimeType(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		declared string
+		data     []byte
+		want     string
+	}{
+		{"png declared as jpeg", "a.jpg", "image/jpeg", pngHeader, "image/png"},
+		{"ogg voice message", "voice.ogg", "audio/ogg", []byte("OggS\x00\x02"), "audio/ogg"},
+		{"plain text", "log.txt", "", []byte("hello world"), "text/plain"},
+		{"unknown uses declared", "x.bin", "application/pdf", []byte{0x00, 0x01, 0x02}, "application/pdf"},
+		{"unknown uses extension", "x.pdf", "", []byte{0x00, 0x01, 0x02}, "application/pdf"},
+		{"unknown", "x", "", []byte{0x00, 0x01, 0x02}, "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffMimeType(tt.file, tt.declared, tt.data); got != tt.want {
+				t.Errorf("SniffMimeType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddAttachment(t *testing.T) {
+	half := MaxAttachmentsSize/2 + 1
+	tests := []struct {
+		name     string
+		existing []Attachment
+		att      Attachment
+		wantErr  error // checked with errors.Is unless nil
+		wantFail bool
+	}{
+		{
+			name: "image",
+			att:  Attachment{Name: "a.png", Data: pngHeader},
+		},
+		{
+			name:     "too large",
+			att:      Attachment{Name: "big.txt", Data: []byte(strings.Repeat("a", MaxAttachmentSize+1))},
+			wantErr:  ErrAttachmentTooLarge,
+			wantFail: true,
+		},
+		{
+			name:     "too large together",
+			existing: []Attachment{{Name: "one.txt", Data: make([]byte, half)}},
+			att:      Attachment{Name: "two.txt", Data: []byte(strings.Repeat("a", half))},
+			wantErr:  ErrAttachmentTooLarge,
+			wantFail: true,
+		},
+		{
+			name:     "too many",
+			existing: make([]Attachment, MaxAttachments),
+			att:      Attachment{Name: "a.png", Data: pngHeader},
+			wantFail: true,
+		},
+		{
+			name:     "unsupported",
+			att:      Attachment{Name: "x.zip", Data: []byte("PK\x03\x04")},
+			wantErr:  ErrUnsupportedAttachment,
+			wantFail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &IncomingMessage{Attachments: tt.existing}
+			err := msg.AddAttachment(tt.att)
+			if tt.wantFail != (err != nil) {
+				t.Fatalf("AddAttachment() error = %v, want failure %v", err, tt.wantFail)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("AddAttachment() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(msg.Attachments) != len(tt.existing)+1 {
+				t.Errorf("attachment was not added")
+			}
+			if err != nil && len(msg.Attachments) != len(tt.existing) {
+				t.Errorf("rejected attachment was added")
+			}
+		})
+	}
+}
+
+func TestAudioDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		declared time.Duration
+		want     time.Duration
+	}{
+		{"estimated", 40000, 0, 10 * time.Second},
+		{"declared longer", 4000, time.Minute, time.Minute},
+		{"declared shorter", 400000, time.Second, 100 * time.Second},
+		{"empty", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			att := Attachment{Data: make([]byte, tt.size), Duration: tt.declared}
+			if got := audioDuration(att); got != tt.want {
+				t.Errorf("audioDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTotalAudioDuration(t *testing.T) {
+	audio := []Attachment{
+		{Data: make([]byte, 8000)},
+		{Data: make([]byte, 4000), Duration: 3 * time.Second},
+	}
+	if got, want := totalAudioDuration(audio), 5*time.Second; got != want {
+		t.Errorf("totalAudioDuration() = %v, want %v", got, want)
+	}
+}
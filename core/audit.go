@@ -0,0 +1,150 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditConfig struct {
+	FilePath string `toml:"file_path"`
+}
+
+const (
+	AuditKindLLM   = "llm"
+	AuditKindAdmin = "admin"
+)
+
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Action   string    `json:"action"`
+	Platform string    `json:"platform,omitempty"`
+	UserID   string    `json:"user_id"`
+	ChatID   string    `json:"chat_id,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Tokens   int       `json:"tokens,omitempty"`
+	Status   string    `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+type AuditFilter struct {
+	Since  time.Time
+	Kind   string
+	UserID string
+	ChatID string
+	Limit  int
+}
+
+func (f AuditFilter) matches(e *AuditEntry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if f.Kind != "" && e.Kind != f.Kind {
+		return false
+	}
+	if f.UserID != "" && e.UserID != f.UserID {
+		return false
+	}
+	if f.ChatID != "" && e.ChatID != f.ChatID {
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only JSONL record of LLM usage and admin actions.
+// It is disabled when no file path is configured.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	filePath string
+}
+
+func NewAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	al := &AuditLog{filePath: cfg.FilePath}
+	if cfg.FilePath == "" {
+		return al, nil
+	}
+
+	f, err := os.OpenFile(cfg.FilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	al.file = f
+	return al, nil
+}
+
+func (al *AuditLog) Enabled() bool {
+	return al != nil && al.file != nil
+}
+
+func (al *AuditLog) Record(entry AuditEntry) {
+	if !al.Enabled() {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to marshal audit entry: %v", err)
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if _, err := al.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit entry: %v", err)
+	}
+}
+
+// Query returns matching entries in chronological order. With a limit,
+// only the most recent entries are kept.
+func (al *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	if !al.Enabled() {
+		return nil, fmt.Errorf("audit log is disabled")
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	f, err := os.Open(al.filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !filter.matches(&entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) > filter.Limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (al *AuditLog) Close() {
+	if !al.Enabled() {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	_ = al.file.Close()
+}
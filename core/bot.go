@@ -1,36 +1,124 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"rakka/core/llm"
-	"rakka/modules"
 )
 
 type BotConfig struct {
-	Name              string  `toml:"name"`
-	SystemPrompt      string  `toml:"system_prompt"`
-	MaxResponseTokens int     `toml:"max_response_tokens"`
-	Temperature       float32 `toml:"temperature"`
-	MaxHistory        int     `toml:"max_conversational_history"`
+	Name              string   `toml:"name"`
+	SystemPrompt      string   `toml:"system_prompt"`
+	MaxResponseTokens int      `toml:"max_response_tokens"`
+	Temperature       *float32 `toml:"temperature"` // nil leaves it to the provider
+	MaxHistory        int      `toml:"max_conversational_history"`
+
+	// models users may pick with `llm model`; empty disables model selection
+	AllowedModels []string `toml:"allowed_models"`
+	// upper bound for `llm set max_tokens`, defaults to max_response_tokens
+	MaxUserTokens int `toml:"max_user_response_tokens"`
+
+	// named system prompts selectable with the persona command
+	Personas         map[string]string `toml:"personas"`
+	MaxPersonaLength int               `toml:"max_persona_length"`
+	// user IDs allowed to run admin commands such as `persona room`
+	Admins []string `toml:"admins"`
+
+	// responses needing more messages than this are sent as a file instead
+	MaxMessageChunks int `toml:"max_message_chunks"`
+
+	// also answer messages that merely contain the bot's name, not only
+	// real mentions
+	RespondToName bool `toml:"respond_to_name"`
+	// by default every message in a direct chat is answered
+	RequireMentionInDMs bool `toml:"require_mention_in_direct_messages"`
+
+	// longest voice message or audio file the bot listens to
+	MaxAudioSeconds int `toml:"max_audio_seconds"`
+}
+
+func (c *BotConfig) MessageChunkLimit() int {
+	if c.MaxMessageChunks > 0 {
+		return c.MaxMessageChunks
+	}
+	return 4
+}
+
+func (c *BotConfig) AudioLengthLimit() time.Duration {
+	if c.MaxAudioSeconds > 0 {
+		return time.Duration(c.MaxAudioSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func (c *BotConfig) IsAdmin(userID string) bool {
+	for _, admin := range c.Admins {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BotConfig) PersonaLengthLimit() int {
+	if c.MaxPersonaLength > 0 {
+		return c.MaxPersonaLength
+	}
+	return 1000
+}
+
+// FindPersona looks up a persona regardless of case and returns its name
+// as written in the config.
+func (c *BotConfig) FindPersona(name string) (string, bool) {
+	if _, ok := c.Personas[name]; ok {
+		return name, true
+	}
+	for key := range c.Personas {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (c *BotConfig) IsModelAllowed(model string) bool {
+	for _, allowed := range c.AllowedModels {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BotConfig) UserTokenLimit() int {
+	if c.MaxUserTokens > 0 {
+		return c.MaxUserTokens
+	}
+	return c.MaxResponseTokens
 }
 
 type Bot struct {
 	LLM         llm.Provider
 	Config      *BotConfig
 	UserCredits *CreditManager
+	Rooms       *RoomManager
 	Context     *ContextManager
+	Audit       *AuditLog
 	Commands    *CommandRegistry
 }
 
-func NewBot(provider llm.Provider, cfg *BotConfig, credits *CreditManager, ctx *ContextManager) *Bot {
+func NewBot(provider llm.Provider, cfg *BotConfig, credits *CreditManager, rooms *RoomManager, ctx *ContextManager, audit *AuditLog) *Bot {
 	return &Bot{
 		LLM:         provider,
 		Config:      cfg,
 		UserCredits: credits,
+		Rooms:       rooms,
 		Context:     ctx,
+		Audit:       audit,
 		Commands:    NewCommandRegistry(),
 	}
 }
@@ -65,231 +153,344 @@ func (b *Bot) HandleMessage(msg IncomingMessage, responder Responder) {
 		}
 	}
 
-	// check direct mention
-	isDirect := false
-	if strings.HasPrefix(msgLower, prefix) {
-		isDirect = true
-	} else if strings.Contains(msgLower, strings.ToLower(b.Config.Name)) {
-		isDirect = true
+	if !b.IsAddressed(&msg) {
+		return
 	}
 
-	if !isDirect {
+	if problem := msg.attachmentProblem(); problem != "" {
+		b.reply(&msg, responder, problem)
 		return
 	}
 
 	// check credits
-	if !b.UserCredits.CanUseAPI(msg.UserID) {
-		responder.SendText(msg.ChatID, fmt.Sprintf("Sorry, you've reached your API usage limit. Use `!%s llm setkey <your_api_key>` to add your own Gemini API key.", b.Config.Name))
+	if !b.UserCredits.CanUseAPI(msg.UserID, b.LLM.ID()) {
+		b.reply(&msg, responder, b.denyOverLimit(&msg, "prompt"))
+		return
+	}
+
+	if _, problem := b.checkAudio(&msg); problem != "" {
+		b.reply(&msg, responder, problem)
 		return
 	}
 
+	b.react(&msg, responder, "👀")
+
 	// process message
-	if msg.IsImage {
-		b.processImage(&msg, responder)
+	var ok bool
+	if len(msg.Attachments) > 0 {
+		ok = b.processFiles(&msg, responder)
 	} else {
-		b.processText(&msg, responder)
+		ok = b.processText(&msg, responder)
+	}
+
+	if ok {
+		b.react(&msg, responder, "✅")
+	}
+}
+
+// IsAddressed reports whether msg asks the bot for an answer: it is sent
+// in a direct chat, mentions the bot or starts with the command prefix.
+// Matching the bare name is opt-in since common names like "bot" appear in
+// unrelated messages. Adapters use it to skip downloading files nobody
+// asked about.
+func (b *Bot) IsAddressed(msg *IncomingMessage) bool {
+	if msg.IsDirectMessage && !b.Config.RequireMentionInDMs {
+		return true
+	}
+	if msg.IsMention || b.IsCommand(msg) {
+		return true
 	}
+	return b.Config.RespondToName && strings.Contains(strings.ToLower(msg.Content), strings.ToLower(b.Config.Name))
 }
 
-func (b *Bot) processText(msg *IncomingMessage, responder Responder) {
+// IsCommand reports whether msg starts with the command prefix.
+func (b *Bot) IsCommand(msg *IncomingMessage) bool {
+	return strings.HasPrefix(strings.ToLower(msg.Content), "!"+strings.ToLower(b.Config.Name))
+}
+
+func (b *Bot) processText(msg *IncomingMessage, responder Responder) bool {
 	prompt := strings.ReplaceAll(msg.Content, b.Config.Name, "")
 	prompt = strings.TrimSpace(prompt)
 
-	history := b.Context.GetConversationHistory(msg.ChatID, msg.UserID)
+	history := b.Context.GetConversationHistory(b.conversationKey(msg))
 	conversationText := ""
 	if history != "" {
 		conversationText += "Conversation history:\n" + history + "\n\n"
 	}
-	conversationText += prompt
+	conversationText += quotedReply(msg) + prompt
 
-	userKey, _ := b.UserCredits.GetUserAPIKey(msg.UserID)
-	useSearch := b.UserCredits.IsSearchEnabled(msg.UserID)
-
-	response, tokensUsed, err := b.LLM.GenerateText(conversationText, llm.RequestConfig{
-		UserKeyOverride: userKey,
-		Temperature:     b.Config.Temperature,
-		MaxTokens:       b.Config.MaxResponseTokens,
-		SystemPrompt:    b.Config.SystemPrompt,
-		UseSearch:       useSearch,
-	})
+	reqCfg := b.requestConfig(msg)
+	stopTyping := responder.StartTyping(msg.ChatID)
+	response, tokensUsed, err := b.LLM.GenerateText(conversationText, reqCfg)
+	stopTyping()
+	b.auditLLM(msg, "text", reqCfg, tokensUsed, err)
 	if err != nil {
 		log.Printf("LLM Error: %v", err)
-		responder.SendText(msg.ChatID, "I'm having trouble thinking right now.")
-		return
+		b.reply(msg, responder, "I'm having trouble thinking right now.")
+		return false
 	}
 
-	b.Context.AddMessage(msg.ChatID, msg.UserID, "user", prompt)
-	b.Context.AddMessage(msg.ChatID, msg.UserID, "bot", response)
-	b.UserCredits.RecordUsage(msg.UserID, tokensUsed)
+	key := b.conversationKey(msg)
+	b.Context.AddMessage(key, "user", prompt)
+	b.Context.AddMessage(key, "bot", response)
+	b.UserCredits.RecordUsage(msg.UserID, b.LLM.ID(), tokensUsed)
 
-	responder.SendText(msg.ChatID, response)
+	return b.reply(msg, responder, response) == nil
 }
 
-func (b *Bot) processImage(msg *IncomingMessage, responder Responder) {
-	responder.SendText(msg.ChatID, "👀 Analyzing image...")
-
+func (b *Bot) processFiles(msg *IncomingMessage, responder Responder) bool {
 	prompt := strings.ReplaceAll(msg.Content, b.Config.Name, "")
 	prompt = strings.TrimSpace(prompt)
 	if prompt == "" {
-		prompt = "Describe the image."
+		switch {
+		case msg.hasOnly("image/"):
+			prompt = "Describe the image."
+		case msg.hasOnly("audio/"):
+			prompt = "Listen to the voice message and answer it."
+		default:
+			prompt = "Summarize the attached file."
+		}
 	}
 
-	history := b.Context.GetConversationHistory(msg.ChatID, msg.UserID)
+	history := b.Context.GetConversationHistory(b.conversationKey(msg))
 
 	conversationText := ""
 	if history != "" {
 		conversationText += "Conversation history:\n" + history + "\n\n"
 	}
-	conversationText += prompt
-
-	userKey, _ := b.UserCredits.GetUserAPIKey(msg.UserID)
-	useSearch := b.UserCredits.IsSearchEnabled(msg.UserID)
+	conversationText += quotedReply(msg) + prompt
 
-	response, tokensUsed, err := b.LLM.GenerateVision(conversationText, msg.ImageData, msg.ImageMimeType, llm.RequestConfig{
-		UserKeyOverride: userKey,
-		Temperature:     b.Config.Temperature,
-		MaxTokens:       b.Config.MaxResponseTokens,
-		SystemPrompt:    b.Config.SystemPrompt,
-		UseSearch:       useSearch,
-	})
+	reqCfg := b.requestConfig(msg)
+	stopTyping := responder.StartTyping(msg.ChatID)
+	files := make([]llm.File, len(msg.Attachments))
+	for i, att := range msg.Attachments {
+		files[i] = llm.File{Name: att.Name, MimeType: att.MimeType, Data: att.Data}
+	}
+	response, tokensUsed, err := b.LLM.GenerateWithFiles(conversationText, files, reqCfg)
+	stopTyping()
+	b.auditLLM(msg, "vision", reqCfg, tokensUsed, err)
 
+	var unsupported *llm.UnsupportedFileError
+	if errors.As(err, &unsupported) {
+		b.reply(msg, responder, fmt.Sprintf("⚠️ The `%s` provider can't read %s.", unsupported.Provider, fileKind(unsupported.MimeType)))
+		return false
+	}
 	if err != nil {
 		log.Printf("Vision Error: %v", err)
-		responder.SendText(msg.ChatID, "Error analyzing image.")
-		return
+		b.reply(msg, responder, "Error analyzing the attachment.")
+		return false
 	}
 
-	b.Context.AddMessage(msg.ChatID, msg.UserID, "user", prompt)
-	b.Context.AddMessage(msg.ChatID, msg.UserID, "bot", response)
-	b.UserCredits.RecordUsage(msg.UserID, tokensUsed)
+	// transcription endpoints don't report tokens, so audio costs at least
+	// its length
+	if cost := b.UserCredits.AudioCost(totalAudioDuration(msg.audioAttachments())); cost > tokensUsed {
+		tokensUsed = cost
+	}
+
+	key := b.conversationKey(msg)
+	b.Context.AddMessage(key, "user", prompt)
+	b.Context.AddMessage(key, "bot", response)
+	b.UserCredits.RecordUsage(msg.UserID, b.LLM.ID(), tokensUsed)
 
-	responder.SendText(msg.ChatID, response)
+	return b.reply(msg, responder, response) == nil
 }
 
-func (b *Bot) handleCommand(msg IncomingMessage, responder Responder) bool {
-	parts := strings.Fields(msg.Content)
-	if len(parts) < 2 {
-		return false
+// denyOverLimit records a request refused for lack of credits and returns
+// the message to send instead.
+func (b *Bot) denyOverLimit(msg *IncomingMessage, action string) string {
+	b.Audit.Record(AuditEntry{
+		Kind:     AuditKindLLM,
+		Action:   action,
+		Platform: msg.Platform,
+		UserID:   msg.UserID,
+		ChatID:   msg.ChatID,
+		Provider: b.LLM.ID(),
+		Status:   "denied",
+		Detail:   "usage limit reached",
+	})
+	return fmt.Sprintf("Sorry, you've reached your API usage limit. Use `!%s llm setkey %s <your_api_key>` to add your own API key.", b.Config.Name, b.LLM.ID())
+}
+
+// checkAudio enforces the length limit for audio attachments and returns
+// their cost, or a message explaining why they can't be processed.
+func (b *Bot) checkAudio(msg *IncomingMessage) (int, string) {
+	audio := msg.audioAttachments()
+	limit := b.Config.AudioLengthLimit()
+	for _, att := range audio {
+		if audioDuration(att) > limit {
+			return 0, fmt.Sprintf("Sorry, I only listen to audio up to %s long.", limit)
+		}
+	}
+
+	cost := b.UserCredits.AudioCost(totalAudioDuration(audio))
+	if !b.UserCredits.CanAfford(msg.UserID, b.LLM.ID(), cost) {
+		return 0, fmt.Sprintf("Sorry, that audio needs about %d tokens, more than you have left. Use `!%s llm setkey %s <your_api_key>` to add your own API key.", cost, b.Config.Name, b.LLM.ID())
 	}
+	return cost, ""
+}
 
-	cmd := strings.ToLower(parts[1])
-	args := parts[2:]
+// quotedReply quotes the message msg replies to, so that questions like
+// "what does this mean?" have something to refer to.
+func quotedReply(msg *IncomingMessage) string {
+	if msg.ReplyTo == nil {
+		return ""
+	}
+	text := strings.TrimSpace(msg.ReplyTo.Content)
+	if text == "" {
+		return ""
+	}
+	text = truncateRunes(text, 2000)
+	return fmt.Sprintf("In reply to %s:\n> %s\n\n", msg.ReplyTo.UserName, strings.ReplaceAll(text, "\n", "\n> "))
+}
 
-	switch cmd {
-	case "llm":
-		if len(args) < 2 {
-			responder.SendText(msg.ChatID, "Usage: `llm <subcommand> <args>`")
-			return true
-		}
-		subcmd := strings.ToLower(args[0])
-		subargs := args[1:]
-
-		switch subcmd {
-		case "setkey":
-			if len(subargs) != 1 {
-				responder.SendText(msg.ChatID, "Usage: `llm setkey <your_api_key>`")
-				return true
-			}
-			apiKey := subargs[0]
-			b.UserCredits.SetUserAPIKey(msg.UserID, apiKey)
-			responder.SendText(msg.ChatID, "✅ Your API key has been set.")
-
-		case "stats":
-			tokens, hasKey := b.UserCredits.GetUserStats(msg.UserID)
-			resp := fmt.Sprintf("Tokens used: %d", tokens)
-			if hasKey {
-				resp += " (using your own API key)"
-			} else {
-				resp += fmt.Sprintf(" (global limit: %d)", b.UserCredits.globalLimit)
-			}
-			responder.SendText(msg.ChatID, resp)
+func (b *Bot) conversationKey(msg *IncomingMessage) string {
+	key := b.Context.GetConversationKey(msg.ChatID, msg.ThreadID, msg.UserID)
+	// each persona account keeps its own conversation
+	if msg.Persona != "" {
+		key += "|" + msg.Persona
+	}
+	return key
+}
 
-		case "clear":
-			b.Context.ClearConversation(msg.ChatID, msg.UserID)
-			responder.SendText(msg.ChatID, "✅ Your conversation history has been cleared.")
+// reply answers msg threaded to it, or as a plain message if the platform
+// gave us no message ID.
+func (b *Bot) reply(msg *IncomingMessage, responder Responder, text string) error {
+	var err error
+	if msg.MessageID != "" {
+		err = responder.ReplyText(msg.ChatID, msg.MessageID, text)
+	} else {
+		err = responder.SendText(msg.ChatID, text)
+	}
+	if err != nil {
+		log.Printf("Failed to send reply in %s: %v", msg.ChatID, err)
+	}
+	return err
+}
 
-		case "enable":
-			if len(subargs) < 1 {
-				responder.SendText(msg.ChatID, "Usage: `llm enable <feature>`")
-				return true
-			}
-			feature := strings.ToLower(subargs[0])
-			b.UserCredits.SetSearchEnabled(msg.UserID, true) // Assuming search is the only feature for now
-			responder.SendText(msg.ChatID, fmt.Sprintf("Feature `%s` has been enabled for you.", feature))
-
-		case "disable":
-			if len(subargs) < 1 {
-				responder.SendText(msg.ChatID, "Usage: `llm disable <feature>`")
-				return true
-			}
-			feature := strings.ToLower(subargs[0])
-			b.UserCredits.SetSearchEnabled(msg.UserID, false)
-			responder.SendText(msg.ChatID, fmt.Sprintf("Feature `%s` has been disabled for you.", feature))
+func (b *Bot) react(msg *IncomingMessage, responder Responder, emoji string) {
+	if msg.MessageID == "" {
+		return
+	}
+	if err := responder.SendReaction(msg.ChatID, msg.MessageID, emoji); err != nil {
+		log.Printf("Failed to react in %s: %v", msg.ChatID, err)
+	}
+}
 
-		default:
-			responder.SendText(msg.ChatID, "Unknown llm subcommand. Available subcommands: `setkey`, `enable`, `disable`")
-		}
-		return true
+// requestConfig merges the bot defaults with the user's stored key and preferences.
+func (b *Bot) requestConfig(msg *IncomingMessage) llm.RequestConfig {
+	userKey, _ := b.UserCredits.GetUserAPIKey(msg.UserID, b.LLM.ID())
+	prefs := b.UserCredits.GetUserPreferences(msg.UserID)
 
-	case "anime":
-		if len(args) < 1 {
-			responder.SendText(msg.ChatID, "Usage: `anime <title>`")
-			return true
-		}
-		res, _ := modules.GetAnimeInfo(strings.Join(args, " "))
-		responder.SendText(msg.ChatID, res)
-		return true
+	cfg := llm.RequestConfig{
+		UserKeyOverride: userKey,
+		MaxTokens:       b.Config.MaxResponseTokens,
+		Temperature:     b.Config.Temperature,
+		SystemPrompt:    b.activePersona(msg).Prompt,
+		UseSearch:       b.UserCredits.IsSearchEnabled(msg.UserID),
+	}
 
-	case "manga":
-		if len(args) < 1 {
-			responder.SendText(msg.ChatID, "Usage: `manga <title>`")
-			return true
-		}
-		res, _ := modules.GetMangaInfo(strings.Join(args, " "))
-		responder.SendText(msg.ChatID, res)
-		return true
+	// the allowlist may have changed since the preference was stored
+	if prefs.Model != "" && b.Config.IsModelAllowed(prefs.Model) {
+		cfg.Model = prefs.Model
+	}
+	if prefs.Temperature != nil {
+		cfg.Temperature = prefs.Temperature
+	}
+	if prefs.MaxTokens > 0 && prefs.MaxTokens <= b.Config.UserTokenLimit() {
+		cfg.MaxTokens = prefs.MaxTokens
+	}
+	return cfg
+}
 
-	case "wiki":
-		if len(args) < 1 {
-			responder.SendText(msg.ChatID, "Usage: `wiki <term>`")
-			return true
-		}
-		res, _ := modules.GetWikiSummary(strings.Join(args, " "))
-		responder.SendText(msg.ChatID, res)
-		return true
+type Persona struct {
+	Name   string // persona name, or "custom" for free-form prompts
+	Source string // "account", "room", "user" or "default"
+	Prompt string
+}
 
-	case "urban":
-		if len(args) < 1 {
-			responder.SendText(msg.ChatID, "Usage: `urban <term>`")
-			return true
-		}
-		term := strings.Join(args, " ")
-		res, err := modules.GetUrbanDef(term)
-		if err != nil {
-			responder.SendText(msg.ChatID, "Error: "+err.Error())
-		} else {
-			responder.SendText(msg.ChatID, res)
-		}
-		return true
+// activePersona picks the system prompt for a message. A message to a
+// persona's own bot account gets that persona. Otherwise room settings win
+// over user settings so that rooms can enforce a tone, and both fall back
+// to the global system prompt. Named personas removed from the config are
+// ignored.
+func (b *Bot) activePersona(msg *IncomingMessage) Persona {
+	if prompt, ok := b.Config.Personas[msg.Persona]; ok && msg.Persona != "" {
+		return Persona{Name: msg.Persona, Source: "account", Prompt: prompt}
+	}
 
-	case "8ball":
-		if len(args) < 1 {
-			responder.SendText(msg.ChatID, "Usage: `8ball <question>`")
-			return true
-		}
-		question := strings.Join(args, " ")
-		responder.SendText(msg.ChatID, modules.Magic8Ball(question))
-		return true
+	room := b.Rooms.GetRoomSettings(msg.ChatID)
+	if room.CustomPrompt != "" {
+		return Persona{Name: "custom", Source: "room", Prompt: room.CustomPrompt}
+	}
+	if prompt, ok := b.Config.Personas[room.Persona]; ok && room.Persona != "" {
+		return Persona{Name: room.Persona, Source: "room", Prompt: prompt}
+	}
 
-	case "roulette":
-		responder.SendText(msg.ChatID, modules.RussianRoulette(msg.UserName))
-		return true
+	prefs := b.UserCredits.GetUserPreferences(msg.UserID)
+	if prefs.CustomPrompt != "" {
+		return Persona{Name: "custom", Source: "user", Prompt: prefs.CustomPrompt}
+	}
+	if prompt, ok := b.Config.Personas[prefs.Persona]; ok && prefs.Persona != "" {
+		return Persona{Name: prefs.Persona, Source: "user", Prompt: prompt}
+	}
 
-	case "help":
-		responder.SendText(msg.ChatID, "Commands: `anime`, `manga`, `wiki`, `llm setkey`, `llm enable search`.\nOr just chat with me!")
-		return true
+	return Persona{Name: "default", Source: "default", Prompt: b.Config.SystemPrompt}
+}
 
-	default:
-		return false
+// modelName resolves the model a request will actually use.
+func (b *Bot) modelName(cfg llm.RequestConfig) string {
+	if cfg.Model != "" {
+		return cfg.Model
+	}
+	return b.LLM.DefaultModel()
+}
+
+func (b *Bot) auditLLM(msg *IncomingMessage, action string, cfg llm.RequestConfig, tokens int, err error) {
+	entry := AuditEntry{
+		Kind:     AuditKindLLM,
+		Action:   action,
+		Platform: msg.Platform,
+		UserID:   msg.UserID,
+		ChatID:   msg.ChatID,
+		Provider: b.LLM.ID(),
+		Model:    b.modelName(cfg),
+		Tokens:   tokens,
+		Status:   "ok",
+	}
+	if err != nil {
+		entry.Status = "error"
+		entry.Detail = truncateRunes(err.Error(), 200)
+	}
+	b.Audit.Record(entry)
+}
+
+// auditAdmin records a configuration change made through a command.
+func (b *Bot) auditAdmin(msg *IncomingMessage, action string, status string, detail string) {
+	b.Audit.Record(AuditEntry{
+		Kind:     AuditKindAdmin,
+		Action:   action,
+		Platform: msg.Platform,
+		UserID:   msg.UserID,
+		ChatID:   msg.ChatID,
+		Status:   status,
+		Detail:   detail,
+	})
+}
+
+func truncateRunes(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max-3]) + "..."
+}
+
+// providerByID returns the configured provider if it matches id, or a
+// provider with default settings otherwise. It is used to validate keys
+// for providers other than the active one.
+func (b *Bot) providerByID(id string) (llm.Provider, error) {
+	if id == b.LLM.ID() {
+		return b.LLM, nil
 	}
+	return llm.New(llm.Config{Provider: id})
 }
@@ -0,0 +1,30 @@
+package core
+
+import "testing"
+
+func TestIsAddressed(t *testing.T) {
+	tests := []struct {
+		name   string
+		config BotConfig
+		msg    IncomingMessage
+		want   bool
+	}{
+		{"mention", BotConfig{Name: "Rakka"}, IncomingMessage{Content: "hi", IsMention: true}, true},
+		{"command", BotConfig{Name: "Rakka"}, IncomingMessage{Content: "!rakka help"}, true},
+		{"plain message", BotConfig{Name: "Rakka"}, IncomingMessage{Content: "hello everyone"}, false},
+		{"name without opt-in", BotConfig{Name: "Rakka"}, IncomingMessage{Content: "ask rakka"}, false},
+		{"name with opt-in", BotConfig{Name: "Rakka", RespondToName: true}, IncomingMessage{Content: "ask RAKKA"}, true},
+		{"direct message", BotConfig{Name: "Rakka"}, IncomingMessage{Content: "hi", IsDirectMessage: true}, true},
+		{"direct message needing mention", BotConfig{Name: "Rakka", RequireMentionInDMs: true}, IncomingMessage{Content: "hi", IsDirectMessage: true}, false},
+		{"mentioned in direct message", BotConfig{Name: "Rakka", RequireMentionInDMs: true}, IncomingMessage{Content: "hi", IsDirectMessage: true, IsMention: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{Config: &tt.config}
+			if got := b.IsAddressed(&tt.msg); got != tt.want {
+				t.Errorf("IsAddressed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// LongMessageNotice accompanies responses that are sent as a file because
+// they would take too many messages.
+const LongMessageNotice = "📄 The response was too long, so here it is as a file."
+
+const fenceMarker = "```"
+
+// maxFenceInfo is the longest language tag carried over when a code block
+// is reopened; anything longer is more likely text than a language.
+const maxFenceInfo = 20
+
+// SplitMessage breaks text into chunks of at most limit bytes. It prefers
+// paragraph, then line, then word boundaries and never splits a UTF-8
+// sequence. A code block that spans chunks is closed at the end of one
+// chunk and reopened, with its language, at the start of the next, as long
+// as the limit leaves room for that. limit must be at least utf8.UTFMax.
+func SplitMessage(text string, limit int) []string {
+	text = strings.TrimSpace(text)
+	if len(text) <= limit {
+		return []string{text}
+	}
+
+	var chunks []string
+	fence := ""
+	rest := text
+	for rest != "" {
+		prefix := ""
+		if fence != "" {
+			prefix = fence + "\n"
+		}
+		if len(prefix)+len(rest) <= limit {
+			chunks = append(chunks, prefix+rest)
+			break
+		}
+
+		// room for the closing fence we may have to append; on very small
+		// limits the code block is simply left unbalanced
+		reserve := len("\n" + fenceMarker)
+		if limit-len(prefix)-reserve < limit/2 {
+			prefix, reserve = "", 0
+		}
+
+		end, next := splitPoint(rest, limit-len(prefix)-reserve)
+		chunk := prefix + strings.TrimRight(rest[:end], " \n")
+		rest = rest[next:]
+
+		fence = openFence(fence, chunk[len(prefix):])
+		if fence != "" && reserve > 0 {
+			chunk += "\n" + fenceMarker
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// splitPoint picks where to cut s so that the first part fits in max bytes.
+// It returns the end of the first part and the start of the remainder,
+// which skips the separator that was split on.
+func splitPoint(s string, max int) (end int, next int) {
+	if max < 1 {
+		max = 1
+	}
+	for max > 0 && max < len(s) && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	if max == 0 {
+		// a single rune wider than the budget; emit it whole
+		_, size := utf8.DecodeRuneInString(s)
+		return size, size
+	}
+
+	window := s[:max]
+	// don't produce tiny chunks just to hit a nicer boundary
+	minCut := max / 4
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(window, sep); i > minCut {
+			return i, i + len(sep)
+		}
+	}
+	return max, max
+}
+
+// openFence returns the opening line of the code block that is still open
+// after part, given the block that was open before it. Lines like
+// "```ls -la```" that close on the same line don't open a block.
+func openFence(fence string, part string) string {
+	for _, line := range strings.Split(part, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, fenceMarker) {
+			continue
+		}
+		info := strings.TrimLeft(trimmed, "`")
+		if fence != "" {
+			if info == "" {
+				fence = ""
+			}
+			continue
+		}
+		if strings.Contains(info, fenceMarker) {
+			continue
+		}
+		if len(info) > maxFenceInfo {
+			trimmed = fenceMarker
+		}
+		fence = trimmed
+	}
+	return fence
+}
+
+// TextAttachment picks a file name and MIME type for sending text as a file.
+func TextAttachment(text string) (name string, mimeType string) {
+	for _, marker := range []string{fenceMarker, "**", "\n#", "\n- ", "\n|"} {
+		if strings.Contains(text, marker) {
+			return "response.md", "text/markdown"
+		}
+	}
+	return "response.txt", "text/plain"
+}
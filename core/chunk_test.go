@@ -0,0 +1,113 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fenceLines counts the lines of s that open or close a code block.
+func fenceLines(s string) int {
+	count := 0
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		info := strings.TrimLeft(trimmed, "`")
+		if strings.HasPrefix(trimmed, fenceMarker) && !strings.Contains(info, fenceMarker) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		limit    int
+		chunks   int  // expected number of chunks, 0 to skip the check
+		balanced bool // every chunk has matching fences
+	}{
+		{
+			name:   "short",
+			text:   "hello",
+			limit:  10,
+			chunks: 1,
+		},
+		{
+			name:     "paragraphs",
+			text:     strings.Repeat("word ", 100) + "\n\n" + strings.Repeat("more ", 100),
+			limit:    600,
+			chunks:   2,
+			balanced: true,
+		},
+		{
+			name:     "code block across chunks",
+			text:     "```go\n" + strings.Repeat("fmt.Println(1)\n", 300) + "```",
+			limit:    2000,
+			balanced: true,
+		},
+		{
+			name:     "inline fence",
+			text:     "```ls -la```\n" + strings.Repeat("text ", 1000),
+			limit:    2000,
+			balanced: true,
+		},
+		{
+			name:  "long fence line",
+			text:  "```" + strings.Repeat("a", 5000) + "```",
+			limit: 2000,
+		},
+		{
+			name:     "long language tag",
+			text:     "```" + strings.Repeat("b", 100) + "\n" + strings.Repeat("c ", 2000) + "\n```",
+			limit:    2000,
+			balanced: true,
+		},
+		{
+			name:  "multibyte",
+			text:  strings.Repeat("ü€😀", 1000),
+			limit: 2000,
+		},
+		{
+			name:  "multibyte in code",
+			text:  "```\n" + strings.Repeat("日本語", 1000) + "\n```",
+			limit: 500,
+		},
+		{
+			name:  "tiny limit",
+			text:  "```go\n" + strings.Repeat("x", 50) + "\n```",
+			limit: utf8.UTFMax,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := SplitMessage(tt.text, tt.limit)
+			if tt.chunks != 0 && len(chunks) != tt.chunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tt.chunks)
+			}
+			if len(chunks) > len(tt.text) {
+				t.Fatalf("got %d chunks for %d bytes", len(chunks), len(tt.text))
+			}
+			for i, chunk := range chunks {
+				if len(chunk) > tt.limit {
+					t.Errorf("chunk %d is %d bytes, limit %d", i, len(chunk), tt.limit)
+				}
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk %d is not valid UTF-8", i)
+				}
+				if tt.balanced && fenceLines(chunk)%2 != 0 {
+					t.Errorf("chunk %d has unbalanced fences:\n%s", i, chunk)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitMessageKeepsText(t *testing.T) {
+	text := strings.Repeat("line of text\n", 500)
+	joined := strings.Join(SplitMessage(text, 1000), "\n")
+	if strings.Count(joined, "line of text") != 500 {
+		t.Errorf("lost text while splitting")
+	}
+}
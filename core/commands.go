@@ -1,8 +1,13 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"rakka/modules"
 )
@@ -14,6 +19,27 @@ type CommandContext struct {
 	Args      []string
 }
 
+// Reply answers the triggering message, threaded to it where the platform allows.
+func (ctx CommandContext) Reply(text string) error {
+	return ctx.Bot.reply(&ctx.Msg, ctx.Responder, text)
+}
+
+// RawArgs returns the message text after the first n arguments with its
+// original spacing and line breaks, for commands that take free-form text.
+func (ctx CommandContext) RawArgs(n int) string {
+	rest := ctx.Msg.Content
+	// skip the prefix and the command name as well
+	for i := 0; i < n+2; i++ {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		rest = rest[end:]
+	}
+	return strings.TrimSpace(rest)
+}
+
 type CommandHandler func(ctx CommandContext) error
 
 type CommandRegistry struct {
@@ -33,7 +59,7 @@ func (r *CommandRegistry) Register(name string, handler CommandHandler) {
 func (r *CommandRegistry) Execute(name string, ctx CommandContext) bool {
 	if handler, exists := r.commands[strings.ToLower(name)]; exists {
 		if err := handler(ctx); err != nil {
-			_ = ctx.Responder.SendText(ctx.Msg.ChatID, fmt.Sprintf("⚠️ Error executing command: %v", err))
+			_ = ctx.Reply(fmt.Sprintf("⚠️ Error executing command: %v", err))
 		}
 		return true
 	}
@@ -42,71 +68,93 @@ func (r *CommandRegistry) Execute(name string, ctx CommandContext) bool {
 
 func RegisterDefaultCommands(b *Bot) {
 	b.Commands.Register("help", func(ctx CommandContext) error {
-		helpText := "Commands: `anime`, `manga`, `wiki`, `urban`, `8ball`, `roulette`.\n" +
-			"LLM Tools: `llm setkey`, `llm stats`, `llm clear`, `llm enable search`.\n" +
+		adminCommands := "`audit`, `quota`, `persona room`"
+		if verifier, ok := ctx.Responder.(DeviceVerifier); ok && verifier.CanVerify() {
+			adminCommands += ", `verify`"
+		}
+		helpText := "Commands: `anime`, `manga`, `wiki`, `urban`, `8ball`, `roulette`, `imagine`, `transcribe`.\n" +
+			"LLM Tools: `llm setkey`, `llm keys`, `llm delkey`, `llm model`, `llm set`, `llm stats`, `llm clear`, `llm enable search`.\n" +
+			"Personas: `persona`, `persona list`, `persona use`, `persona set`, `persona reset`.\n" +
+			"Admin: " + adminCommands + ".\n" +
 			"Or just chat with me!"
-		return ctx.Responder.SendText(ctx.Msg.ChatID, helpText)
+		return ctx.Reply(helpText)
 	})
 
+	// the platform does the work, so registering it here keeps the
+	// registry unchanged once adapters are running
+	b.Commands.Register("verify", AdminOnly(func(ctx CommandContext) error {
+		verifier, ok := ctx.Responder.(DeviceVerifier)
+		if !ok || !verifier.CanVerify() {
+			return ctx.Reply("Device verification is only available on Matrix with encryption enabled.")
+		}
+		return verifier.VerifyCommand(ctx)
+	}))
+
 	b.Commands.Register("anime", func(ctx CommandContext) error {
 		if len(ctx.Args) < 1 {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `anime <title>`")
+			return ctx.Reply("Usage: `anime <title>`")
+		}
+		info, err := modules.GetAnimeInfo(strings.Join(ctx.Args, " "))
+		if errors.Is(err, modules.ErrNotFound) {
+			return ctx.Reply("Anime not found.")
 		}
-		res, err := modules.GetAnimeInfo(strings.Join(ctx.Args, " "))
 		if err != nil {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Error finding anime: "+err.Error())
+			return ctx.Reply("Error finding anime: " + err.Error())
 		}
-		return ctx.Responder.SendText(ctx.Msg.ChatID, res)
+		return ctx.SendRich(animeCard(info))
 	})
 
 	b.Commands.Register("manga", func(ctx CommandContext) error {
 		if len(ctx.Args) < 1 {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `manga <title>`")
+			return ctx.Reply("Usage: `manga <title>`")
+		}
+		info, err := modules.GetMangaInfo(strings.Join(ctx.Args, " "))
+		if errors.Is(err, modules.ErrNotFound) {
+			return ctx.Reply("Manga not found.")
 		}
-		res, err := modules.GetMangaInfo(strings.Join(ctx.Args, " "))
 		if err != nil {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Error finding manga: "+err.Error())
+			return ctx.Reply("Error finding manga: " + err.Error())
 		}
-		return ctx.Responder.SendText(ctx.Msg.ChatID, res)
+		return ctx.SendRich(mangaCard(info))
 	})
 
 	b.Commands.Register("wiki", func(ctx CommandContext) error {
 		if len(ctx.Args) < 1 {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `wiki <term>`")
+			return ctx.Reply("Usage: `wiki <term>`")
 		}
 		res, err := modules.GetWikiSummary(strings.Join(ctx.Args, " "))
 		if err != nil {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Error: "+err.Error())
+			return ctx.Reply("Error: " + err.Error())
 		}
-		return ctx.Responder.SendText(ctx.Msg.ChatID, res)
+		return ctx.Reply(res)
 	})
 
 	b.Commands.Register("urban", func(ctx CommandContext) error {
 		if len(ctx.Args) < 1 {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `urban <term>`")
+			return ctx.Reply("Usage: `urban <term>`")
 		}
 		res, err := modules.GetUrbanDef(strings.Join(ctx.Args, " "))
 		if err != nil {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Error: "+err.Error())
+			return ctx.Reply("Error: " + err.Error())
 		}
-		return ctx.Responder.SendText(ctx.Msg.ChatID, res)
+		return ctx.Reply(res)
 	})
 
 	b.Commands.Register("8ball", func(ctx CommandContext) error {
 		if len(ctx.Args) < 1 {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `8ball <question>`")
+			return ctx.Reply("Usage: `8ball <question>`")
 		}
 		question := strings.Join(ctx.Args, " ")
-		return ctx.Responder.SendText(ctx.Msg.ChatID, modules.Magic8Ball(question))
+		return ctx.Reply(modules.Magic8Ball(question))
 	})
 
 	b.Commands.Register("roulette", func(ctx CommandContext) error {
-		return ctx.Responder.SendText(ctx.Msg.ChatID, modules.RussianRoulette(ctx.Msg.UserName))
+		return ctx.Reply(modules.RussianRoulette(ctx.Msg.UserName))
 	})
 
 	b.Commands.Register("llm", func(ctx CommandContext) error {
 		if len(ctx.Args) < 1 {
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `llm <subcommand> <args>`\nSubcommands: `setkey`, `stats`, `clear`, `enable`, `disable`")
+			return ctx.Reply("Usage: `llm <subcommand> <args>`\nSubcommands: `setkey`, `keys`, `delkey`, `model`, `set`, `stats`, `clear`, `enable`, `disable`")
 		}
 
 		subcmd := strings.ToLower(ctx.Args[0])
@@ -114,53 +162,338 @@ func RegisterDefaultCommands(b *Bot) {
 
 		switch subcmd {
 		case "setkey":
-			if len(subargs) != 1 {
-				return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `llm setkey <your_api_key>`")
+			if !ctx.Msg.IsDirectMessage {
+				return setKeyOutsideDM(ctx, len(subargs) > 0)
+			}
+			if len(subargs) > 0 {
+				defer func() {
+					if err := ctx.Responder.DeleteMessage(ctx.Msg.ChatID, ctx.Msg.MessageID); err != nil {
+						log.Printf("Failed to remove setkey message: %v", err)
+					}
+				}()
+			}
+
+			provider := ctx.Bot.LLM.ID()
+			var apiKey string
+			switch len(subargs) {
+			case 1:
+				apiKey = subargs[0]
+			case 2:
+				provider = strings.ToLower(subargs[0])
+				apiKey = subargs[1]
+			default:
+				return ctx.Reply("Usage: `llm setkey [provider] <your_api_key>`")
+			}
+
+			validator, err := ctx.Bot.providerByID(provider)
+			if err != nil {
+				return ctx.Reply(fmt.Sprintf("Unknown provider `%s`.", provider))
+			}
+			if err := validator.ValidateKey(apiKey); err != nil {
+				ctx.Bot.auditAdmin(&ctx.Msg, "setkey", "rejected", provider)
+				return ctx.Reply(fmt.Sprintf("❌ That key was rejected by %s: %v", provider, err))
 			}
-			err := ctx.Bot.UserCredits.SetUserAPIKey(ctx.Msg.UserID, subargs[0])
+
+			err = ctx.Bot.UserCredits.SetUserAPIKey(ctx.Msg.UserID, provider, apiKey)
 			if err != nil {
-				return ctx.Responder.SendText(ctx.Msg.ChatID, "Failed to securely save API key: "+err.Error())
+				return ctx.Reply("Failed to securely save API key: " + err.Error())
+			}
+			ctx.Bot.auditAdmin(&ctx.Msg, "setkey", "ok", provider)
+			return ctx.Reply(fmt.Sprintf("✅ Your %s API key has been verified and set securely.", provider))
+
+		case "keys":
+			providers := ctx.Bot.UserCredits.GetUserKeyProviders(ctx.Msg.UserID)
+			if len(providers) == 0 {
+				return ctx.Reply("You have no stored API keys.")
+			}
+			var sb strings.Builder
+			sb.WriteString("Your stored API keys:\n")
+			for _, provider := range providers {
+				key, err := ctx.Bot.UserCredits.GetUserAPIKey(ctx.Msg.UserID, provider)
+				if err != nil {
+					sb.WriteString(fmt.Sprintf("- `%s`: (unreadable)\n", provider))
+					continue
+				}
+				active := ""
+				if provider == ctx.Bot.LLM.ID() {
+					active = " (active)"
+				}
+				sb.WriteString(fmt.Sprintf("- `%s`: `%s`%s\n", provider, maskKey(key), active))
+			}
+			return ctx.Reply(sb.String())
+
+		case "delkey":
+			if len(subargs) != 1 {
+				return ctx.Reply("Usage: `llm delkey <provider>`")
+			}
+			provider := strings.ToLower(subargs[0])
+			if !ctx.Bot.UserCredits.DeleteUserAPIKey(ctx.Msg.UserID, provider) {
+				return ctx.Reply(fmt.Sprintf("You have no stored key for `%s`.", provider))
 			}
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "✅ Your API key has been set securely.")
+			ctx.Bot.auditAdmin(&ctx.Msg, "delkey", "ok", provider)
+			return ctx.Reply(fmt.Sprintf("🗑️ Your %s API key has been deleted.", provider))
 
 		case "stats":
-			tokens, hasKey := ctx.Bot.UserCredits.GetUserStats(ctx.Msg.UserID)
+			tokens, hasKey := ctx.Bot.UserCredits.GetUserStats(ctx.Msg.UserID, ctx.Bot.LLM.ID())
 			resp := fmt.Sprintf("Tokens used: %d", tokens)
 			if hasKey {
-				resp += " (using your own API key)"
+				resp += fmt.Sprintf(" (using your own %s API key)", ctx.Bot.LLM.ID())
 			} else {
-				resp += fmt.Sprintf(" (global limit: %d)", ctx.Bot.UserCredits.globalLimit)
+				resp += fmt.Sprintf(" (limit: %d)", ctx.Bot.UserCredits.GetUserLimit(ctx.Msg.UserID))
+			}
+			reqCfg := ctx.Bot.requestConfig(&ctx.Msg)
+			temperature := "default"
+			if reqCfg.Temperature != nil {
+				temperature = fmt.Sprintf("%.2f", *reqCfg.Temperature)
+			}
+			resp += fmt.Sprintf("\nModel: `%s` | Temperature: %s | Max tokens: %d", ctx.Bot.modelName(reqCfg), temperature, reqCfg.MaxTokens)
+			persona := ctx.Bot.activePersona(&ctx.Msg)
+			resp += fmt.Sprintf("\nPersona: `%s` (%s)", persona.Name, persona.Source)
+			return ctx.Reply(resp)
+
+		case "model":
+			if len(subargs) == 0 {
+				prefs := ctx.Bot.UserCredits.GetUserPreferences(ctx.Msg.UserID)
+				current := "default"
+				if prefs.Model != "" {
+					current = prefs.Model
+				}
+				resp := fmt.Sprintf("Your model: `%s`", current)
+				if len(ctx.Bot.Config.AllowedModels) > 0 {
+					resp += "\nAvailable: `" + strings.Join(ctx.Bot.Config.AllowedModels, "`, `") + "`"
+				}
+				return ctx.Reply(resp)
+			}
+
+			model := subargs[0]
+			if strings.ToLower(model) == "default" {
+				ctx.Bot.UserCredits.SetUserModel(ctx.Msg.UserID, "")
+				return ctx.Reply("✅ You are now using the default model.")
+			}
+			if len(ctx.Bot.Config.AllowedModels) == 0 {
+				return ctx.Reply("Model selection is disabled on this bot.")
+			}
+			if !ctx.Bot.Config.IsModelAllowed(model) {
+				return ctx.Reply("Unknown model. Available: `" + strings.Join(ctx.Bot.Config.AllowedModels, "`, `") + "`")
+			}
+			ctx.Bot.UserCredits.SetUserModel(ctx.Msg.UserID, model)
+			return ctx.Reply(fmt.Sprintf("✅ You are now using `%s`.", model))
+
+		case "set":
+			if len(subargs) != 2 {
+				return ctx.Reply("Usage: `llm set temperature|max_tokens <value|default>`")
+			}
+			param := strings.ToLower(subargs[0])
+			value := strings.ToLower(subargs[1])
+
+			switch param {
+			case "temperature":
+				if value == "default" {
+					ctx.Bot.UserCredits.SetUserTemperature(ctx.Msg.UserID, nil)
+					return ctx.Reply("✅ Temperature reset to default.")
+				}
+				t, err := strconv.ParseFloat(value, 32)
+				if err != nil || t < 0 || t > 2 {
+					return ctx.Reply("Temperature must be a number between 0 and 2.")
+				}
+				temperature := float32(t)
+				ctx.Bot.UserCredits.SetUserTemperature(ctx.Msg.UserID, &temperature)
+				return ctx.Reply(fmt.Sprintf("✅ Temperature set to %.2f.", temperature))
+
+			case "max_tokens":
+				if value == "default" {
+					ctx.Bot.UserCredits.SetUserMaxTokens(ctx.Msg.UserID, 0)
+					return ctx.Reply("✅ Max tokens reset to default.")
+				}
+				limit := ctx.Bot.Config.UserTokenLimit()
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 || n > limit {
+					return ctx.Reply(fmt.Sprintf("Max tokens must be a number between 1 and %d.", limit))
+				}
+				ctx.Bot.UserCredits.SetUserMaxTokens(ctx.Msg.UserID, n)
+				return ctx.Reply(fmt.Sprintf("✅ Max tokens set to %d.", n))
+
+			default:
+				return ctx.Reply("Unknown parameter. Available: `temperature`, `max_tokens`")
 			}
-			return ctx.Responder.SendText(ctx.Msg.ChatID, resp)
 
 		case "clear":
-			ctx.Bot.Context.ClearConversation(ctx.Msg.ChatID, ctx.Msg.UserID)
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "✅ Your conversation history has been cleared.")
+			ctx.Bot.Context.ClearConversation(ctx.Bot.conversationKey(&ctx.Msg))
+			if ctx.Msg.ThreadID != "" {
+				return ctx.Reply("✅ The conversation history of this thread has been cleared.")
+			}
+			return ctx.Reply("✅ Your conversation history has been cleared.")
 
 		case "enable":
 			if len(subargs) < 1 {
-				return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `llm enable <feature>` (e.g., search)")
+				return ctx.Reply("Usage: `llm enable <feature>` (e.g., search)")
 			}
 			feature := strings.ToLower(subargs[0])
 			if feature == "search" {
 				ctx.Bot.UserCredits.SetSearchEnabled(ctx.Msg.UserID, true)
-				return ctx.Responder.SendText(ctx.Msg.ChatID, "✅ Feature `search` has been enabled for you.")
+				return ctx.Reply("✅ Feature `search` has been enabled for you.")
 			}
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Unknown feature. Available: `search`")
+			return ctx.Reply("Unknown feature. Available: `search`")
 
 		case "disable":
 			if len(subargs) < 1 {
-				return ctx.Responder.SendText(ctx.Msg.ChatID, "Usage: `llm disable <feature>`")
+				return ctx.Reply("Usage: `llm disable <feature>`")
 			}
 			feature := strings.ToLower(subargs[0])
 			if feature == "search" {
 				ctx.Bot.UserCredits.SetSearchEnabled(ctx.Msg.UserID, false)
-				return ctx.Responder.SendText(ctx.Msg.ChatID, "🚫 Feature `search` has been disabled for you.")
+				return ctx.Reply("🚫 Feature `search` has been disabled for you.")
 			}
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Unknown feature. Available: `search`")
+			return ctx.Reply("Unknown feature. Available: `search`")
 
 		default:
-			return ctx.Responder.SendText(ctx.Msg.ChatID, "Unknown llm subcommand.")
+			return ctx.Reply("Unknown llm subcommand.")
 		}
 	})
+
+	b.Commands.Register("persona", personaCommand)
+	b.Commands.Register("imagine", imagineCommand)
+	b.Commands.Register("transcribe", transcribeCommand)
+
+	registerAdminCommands(b)
+}
+
+func personaCommand(ctx CommandContext) error {
+	b := ctx.Bot
+	if len(ctx.Args) == 0 {
+		persona := b.activePersona(&ctx.Msg)
+		return ctx.Reply(fmt.Sprintf(
+			"Active persona: `%s` (%s)\nUsage: `persona list|use <name>|set <prompt>|reset`, admins: `persona room use|set|reset`",
+			persona.Name, persona.Source))
+	}
+
+	subcmd := strings.ToLower(ctx.Args[0])
+	skip := 1
+	scope := "user"
+	if subcmd == "room" {
+		if !b.Config.IsAdmin(ctx.Msg.UserID) {
+			return ctx.Reply("⛔ Only bot admins can change the room persona.")
+		}
+		if len(ctx.Args) < 2 {
+			return ctx.Reply("Usage: `persona room use <name>|set <prompt>|reset`")
+		}
+		scope = "room"
+		subcmd = strings.ToLower(ctx.Args[1])
+		skip = 2
+	}
+	subargs := ctx.Args[skip:]
+
+	switch subcmd {
+	case "list":
+		if len(b.Config.Personas) == 0 {
+			return ctx.Reply("No personas are configured.")
+		}
+		names := make([]string, 0, len(b.Config.Personas))
+		for name := range b.Config.Personas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return ctx.Reply("Personas: `" + strings.Join(names, "`, `") + "`")
+
+	case "use":
+		if len(subargs) != 1 {
+			return ctx.Reply("Usage: `persona use <name>`")
+		}
+		name, ok := b.Config.FindPersona(subargs[0])
+		if !ok {
+			return ctx.Reply(fmt.Sprintf("Unknown persona `%s`. See `persona list`.", subargs[0]))
+		}
+		if scope == "room" {
+			b.Rooms.SetRoomPersona(ctx.Msg.ChatID, name)
+			b.auditAdmin(&ctx.Msg, "persona_room", "ok", "use "+name)
+		} else {
+			b.UserCredits.SetUserPersona(ctx.Msg.UserID, name)
+		}
+		return ctx.Reply(fmt.Sprintf("✅ %s persona set to `%s`.", personaScopeLabel(scope), name))
+
+	case "set":
+		prompt := ctx.RawArgs(skip)
+		if prompt == "" {
+			return ctx.Reply("Usage: `persona set <system prompt>`")
+		}
+		if limit := b.Config.PersonaLengthLimit(); len([]rune(prompt)) > limit {
+			return ctx.Reply(fmt.Sprintf("Custom prompts are limited to %d characters.", limit))
+		}
+		if scope == "room" {
+			b.Rooms.SetRoomPrompt(ctx.Msg.ChatID, prompt)
+			b.auditAdmin(&ctx.Msg, "persona_room", "ok", "set "+truncateRunes(prompt, 200))
+		} else {
+			b.UserCredits.SetUserPrompt(ctx.Msg.UserID, prompt)
+		}
+		return ctx.Reply(fmt.Sprintf("✅ %s custom prompt saved.", personaScopeLabel(scope)))
+
+	case "reset":
+		if scope == "room" {
+			b.Rooms.SetRoomPersona(ctx.Msg.ChatID, "")
+			b.auditAdmin(&ctx.Msg, "persona_room", "ok", "reset")
+		} else {
+			b.UserCredits.SetUserPersona(ctx.Msg.UserID, "")
+		}
+		return ctx.Reply(fmt.Sprintf("✅ %s persona reset.", personaScopeLabel(scope)))
+
+	default:
+		return ctx.Reply("Unknown persona subcommand.")
+	}
+}
+
+func personaScopeLabel(scope string) string {
+	if scope == "room" {
+		return "Room"
+	}
+	return "Your"
+}
+
+// setKeyOutsideDM refuses to handle API keys in shared rooms and moves the
+// conversation to a direct chat instead. If a key was already posted, the
+// message is removed and the user is told to revoke it.
+func setKeyOutsideDM(ctx CommandContext, keyExposed bool) error {
+	removed := false
+	if keyExposed {
+		if err := ctx.Responder.DeleteMessage(ctx.Msg.ChatID, ctx.Msg.MessageID); err != nil {
+			log.Printf("Failed to remove exposed API key message: %v", err)
+		} else {
+			removed = true
+		}
+	}
+
+	dmText := fmt.Sprintf("🔒 Send `!%s llm setkey [provider] <your_api_key>` here to store your key privately.", ctx.Bot.Config.Name)
+	if keyExposed {
+		dmText = "⚠️ The API key you posted in a shared room may already have been seen by others. " +
+			"Please revoke it and create a new one.\n" + dmText
+	}
+
+	roomText := "🔒 `setkey` only works in direct messages."
+	dmID, err := ctx.Responder.OpenDirectChat(ctx.Msg.UserID)
+	if err == nil {
+		err = ctx.Responder.SendText(dmID, dmText)
+	}
+	if err != nil {
+		log.Printf("Failed to open direct chat with %s: %v", ctx.Msg.UserID, err)
+		roomText += " Please start a direct chat with me and try again there."
+	} else {
+		roomText += " I've sent you a direct message."
+	}
+
+	if keyExposed {
+		if removed {
+			roomText += " Your message was removed, but the key was exposed and should be revoked."
+		} else {
+			roomText += " ⚠️ I couldn't remove your message. Please delete it and revoke the key."
+		}
+	}
+	// the triggering message may have been deleted, so don't reply to it
+	return ctx.Responder.SendText(ctx.Msg.ChatID, roomText)
+}
+
+// maskKey hides all but the last four characters of an API key.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return "****" + key[len(key)-4:]
 }
@@ -2,6 +2,7 @@ package core
 
 import (
 	"strings"
+	"sync"
 )
 
 type Message struct {
@@ -14,7 +15,10 @@ type Conversation struct {
 	MaxHistory int       `json:"max_history"`
 }
 
+// ContextManager is shared by all platforms, and a thread's conversation by
+// everyone in it, so all access goes through mu.
 type ContextManager struct {
+	mu            sync.RWMutex
 	conversations map[string]*Conversation
 	maxHistory    int
 }
@@ -26,12 +30,19 @@ func NewContextManager(maxHistory int) *ContextManager {
 	}
 }
 
-func (cm *ContextManager) GetConversationKey(roomID string, userID string) string {
-	return string(roomID) + "|" + string(userID)
+// GetConversationKey identifies a conversation. Each thread is one
+// conversation shared by everyone in it; elsewhere every user has their
+// own conversation per room.
+func (cm *ContextManager) GetConversationKey(roomID string, threadID string, userID string) string {
+	if threadID != "" {
+		return roomID + "|thread|" + threadID
+	}
+	return roomID + "|" + userID
 }
 
-func (cm *ContextManager) AddMessage(roomID string, userID string, role, content string) {
-	key := cm.GetConversationKey(roomID, userID)
+func (cm *ContextManager) AddMessage(key string, role, content string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 
 	if cm.conversations[key] == nil {
 		cm.conversations[key] = &Conversation{
@@ -51,8 +62,12 @@ func (cm *ContextManager) AddMessage(roomID string, userID string, role, content
 	}
 }
 
-func (cm *ContextManager) GetConversationHistory(roomID string, userID string) string {
-	key := cm.GetConversationKey(roomID, userID)
+// GetConversationHistory renders the conversation as text, so callers
+// never hold on to the messages themselves.
+func (cm *ContextManager) GetConversationHistory(key string) string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
 	conv := cm.conversations[key]
 
 	if conv == nil || len(conv.Messages) == 0 {
@@ -67,7 +82,8 @@ func (cm *ContextManager) GetConversationHistory(roomID string, userID string) s
 	return history.String()
 }
 
-func (cm *ContextManager) ClearConversation(roomID string, userID string) {
-	key := cm.GetConversationKey(roomID, userID)
+func (cm *ContextManager) ClearConversation(key string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 	delete(cm.conversations, key)
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,14 +17,41 @@ type CreditsConfig struct {
 	FilePath    string `toml:"file_path"`
 	GlobalLimit int    `toml:"global_limit"`
 	MasterKey   string `toml:"master_key"`
+	ImageCost   int    `toml:"image_cost"`
+	// tokens a minute of audio counts as, see AudioCost
+	AudioCostPerMinute int `toml:"audio_cost_per_minute"`
+}
+
+type StoredKey struct {
+	Encrypted []byte   `json:"encrypted"`
+	Nonce     [24]byte `json:"nonce"`
 }
 
 type UserCredit struct {
-	UserID        string   `json:"user_id"`
-	TokenCount    int      `json:"token_count"`
-	APIKey        []byte   `json:"api_key"`
-	Nonce         [24]byte `json:"nonce"`
-	SearchEnabled bool     `json:"search_enabled"`
+	UserID        string                `json:"user_id"`
+	TokenCount    int                   `json:"token_count"`
+	BonusTokens   int                   `json:"bonus_tokens,omitempty"`
+	APIKeys       map[string]*StoredKey `json:"api_keys,omitempty"`
+	SearchEnabled bool                  `json:"search_enabled"`
+	Model         string                `json:"model,omitempty"`
+	Temperature   *float32              `json:"temperature,omitempty"`
+	MaxTokens     int                   `json:"max_tokens,omitempty"`
+	Persona       string                `json:"persona,omitempty"`
+	CustomPrompt  string                `json:"custom_prompt,omitempty"`
+
+	// single key from before keys were stored per provider, see MigrateLegacyKeys
+	LegacyAPIKey []byte    `json:"api_key,omitempty"`
+	LegacyNonce  *[24]byte `json:"nonce,omitempty"`
+}
+
+// UserPreferences holds per-user generation overrides. Zero values mean
+// the bot's defaults apply.
+type UserPreferences struct {
+	Model        string
+	Temperature  *float32
+	MaxTokens    int
+	Persona      string
+	CustomPrompt string
 }
 
 type CreditManager struct {
@@ -32,6 +60,8 @@ type CreditManager struct {
 	filePath    string
 	masterKey   [32]byte
 	globalLimit int
+	imageCost   int
+	audioCost   int
 	dirty       bool
 }
 
@@ -40,6 +70,8 @@ func NewCreditManager(cfg CreditsConfig) *CreditManager {
 		users:       make(map[string]*UserCredit),
 		filePath:    cfg.FilePath,
 		globalLimit: cfg.GlobalLimit,
+		imageCost:   cfg.ImageCost,
+		audioCost:   cfg.AudioCostPerMinute,
 	}
 
 	keyBytes := make([]byte, 32)
@@ -116,7 +148,43 @@ func (cm *CreditManager) decryptAPIKey(encrypted []byte, nonce [24]byte) (string
 	return string(decrypted), nil
 }
 
-func (cm *CreditManager) SetUserAPIKey(userID string, apiKey string) error {
+// MigrateLegacyKeys moves keys saved before per-provider storage existed
+// under the given provider, which is the one they were used with.
+func (cm *CreditManager) MigrateLegacyKeys(provider string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	migrated := 0
+	for _, user := range cm.users {
+		if user.LegacyAPIKey == nil || user.LegacyNonce == nil {
+			continue
+		}
+		if user.APIKeys == nil {
+			user.APIKeys = make(map[string]*StoredKey)
+		}
+		if _, exists := user.APIKeys[provider]; !exists {
+			user.APIKeys[provider] = &StoredKey{Encrypted: user.LegacyAPIKey, Nonce: *user.LegacyNonce}
+		}
+		user.LegacyAPIKey = nil
+		user.LegacyNonce = nil
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.Printf("Migrated %d legacy API keys to provider %s", migrated, provider)
+		cm.saveToFile()
+	}
+}
+
+func (cm *CreditManager) hasKey(user *UserCredit, provider string) bool {
+	if user == nil {
+		return false
+	}
+	_, ok := user.APIKeys[provider]
+	return ok
+}
+
+func (cm *CreditManager) SetUserAPIKey(userID string, provider string, apiKey string) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
@@ -125,48 +193,83 @@ func (cm *CreditManager) SetUserAPIKey(userID string, apiKey string) error {
 		return err
 	}
 
-	userIDStr := string(userID)
-	if cm.users[userIDStr] == nil {
-		cm.users[userIDStr] = &UserCredit{UserID: userIDStr}
+	if cm.users[userID] == nil {
+		cm.users[userID] = &UserCredit{UserID: userID}
+	}
+	if cm.users[userID].APIKeys == nil {
+		cm.users[userID].APIKeys = make(map[string]*StoredKey)
 	}
 
-	cm.users[userIDStr].APIKey = encrypted
-	cm.users[userIDStr].Nonce = nonce
+	cm.users[userID].APIKeys[provider] = &StoredKey{Encrypted: encrypted, Nonce: nonce}
 
 	cm.saveToFile()
 	return nil
 }
 
-func (cm *CreditManager) GetUserAPIKey(userID string) (string, error) {
+func (cm *CreditManager) GetUserAPIKey(userID string, provider string) (string, error) {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
-	user, exists := cm.users[string(userID)]
-	if !exists || user.APIKey == nil {
-		return "", fmt.Errorf("no API key found for user")
+	user, exists := cm.users[userID]
+	if !exists || !cm.hasKey(user, provider) {
+		return "", fmt.Errorf("no %s API key found for user", provider)
 	}
 
-	return cm.decryptAPIKey(user.APIKey, user.Nonce)
+	key := user.APIKeys[provider]
+	return cm.decryptAPIKey(key.Encrypted, key.Nonce)
 }
 
-func (cm *CreditManager) CanUseAPI(userID string) bool {
+// DeleteUserAPIKey removes the user's key for provider and reports whether one existed.
+func (cm *CreditManager) DeleteUserAPIKey(userID string, provider string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	user, exists := cm.users[userID]
+	if !exists || !cm.hasKey(user, provider) {
+		return false
+	}
+
+	delete(user.APIKeys, provider)
+	cm.saveToFile()
+	return true
+}
+
+// GetUserKeyProviders returns the providers the user has stored keys for, sorted by name.
+func (cm *CreditManager) GetUserKeyProviders(userID string) []string {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
-	user, exists := cm.users[string(userID)]
+	user, exists := cm.users[userID]
+	if !exists {
+		return nil
+	}
 
-	if exists && user.APIKey != nil {
+	providers := make([]string, 0, len(user.APIKeys))
+	for provider := range user.APIKeys {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+func (cm *CreditManager) CanUseAPI(userID string, provider string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	user, exists := cm.users[userID]
+
+	if exists && cm.hasKey(user, provider) {
 		return true
 	}
 
-	if exists && user.TokenCount >= cm.globalLimit {
+	if exists && user.TokenCount >= cm.globalLimit+user.BonusTokens {
 		return false
 	}
 
 	return true
 }
 
-func (cm *CreditManager) RecordUsage(userID string, tokens int) {
+func (cm *CreditManager) RecordUsage(userID string, provider string, tokens int) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
@@ -174,23 +277,88 @@ func (cm *CreditManager) RecordUsage(userID string, tokens int) {
 		cm.users[userID] = &UserCredit{UserID: userID}
 	}
 
-	if cm.users[userID].APIKey == nil {
+	if !cm.hasKey(cm.users[userID], provider) {
 		cm.users[userID].TokenCount += tokens
 	}
 	cm.dirty = true
 }
 
-func (cm *CreditManager) GetUserStats(userID string) (int, bool) {
+// ImageCost is the number of tokens a generated image counts as.
+func (cm *CreditManager) ImageCost() int {
+	if cm.imageCost > 0 {
+		return cm.imageCost
+	}
+	return 1000
+}
+
+// AudioCost is the number of tokens audio of length d counts as. The
+// default matches Gemini, which bills 32 tokens per second.
+func (cm *CreditManager) AudioCost(d time.Duration) int {
+	perMinute := cm.audioCost
+	if perMinute <= 0 {
+		perMinute = 1920
+	}
+	seconds := int((d + time.Second - 1) / time.Second)
+	return seconds * perMinute / 60
+}
+
+// CanAfford reports whether the user has at least tokens left, or uses
+// their own key for provider.
+func (cm *CreditManager) CanAfford(userID string, provider string, tokens int) bool {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
-	user, exists := cm.users[string(userID)]
+	user, exists := cm.users[userID]
+	if !exists {
+		return tokens <= cm.globalLimit
+	}
+	if cm.hasKey(user, provider) {
+		return true
+	}
+	return user.TokenCount+tokens <= cm.globalLimit+user.BonusTokens
+}
+
+func (cm *CreditManager) GetUserStats(userID string, provider string) (int, bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	user, exists := cm.users[userID]
 	if !exists {
 		return 0, false
 	}
 
-	hasOwnKey := user.APIKey != nil
-	return user.TokenCount, hasOwnKey
+	return user.TokenCount, cm.hasKey(user, provider)
+}
+
+// GrantTokens raises the user's limit above the global one by tokens.
+func (cm *CreditManager) GrantTokens(userID string, tokens int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.getOrCreateUser(userID).BonusTokens += tokens
+	cm.saveToFile()
+}
+
+// ResetUsage clears the user's token count and any granted tokens.
+func (cm *CreditManager) ResetUsage(userID string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	user := cm.getOrCreateUser(userID)
+	user.TokenCount = 0
+	user.BonusTokens = 0
+	cm.saveToFile()
+}
+
+// GetUserLimit returns the user's effective token limit.
+func (cm *CreditManager) GetUserLimit(userID string) int {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if user, exists := cm.users[userID]; exists {
+		return cm.globalLimit + user.BonusTokens
+	}
+	return cm.globalLimit
 }
 
 func (cm *CreditManager) SetSearchEnabled(userID string, enabled bool) {
@@ -216,3 +384,73 @@ func (cm *CreditManager) IsSearchEnabled(userID string) bool {
 	}
 	return user.SearchEnabled
 }
+
+func (cm *CreditManager) getOrCreateUser(userID string) *UserCredit {
+	if cm.users[userID] == nil {
+		cm.users[userID] = &UserCredit{UserID: userID}
+	}
+	return cm.users[userID]
+}
+
+func (cm *CreditManager) SetUserModel(userID string, model string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.getOrCreateUser(userID).Model = model
+	cm.saveToFile()
+}
+
+func (cm *CreditManager) SetUserTemperature(userID string, temperature *float32) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.getOrCreateUser(userID).Temperature = temperature
+	cm.saveToFile()
+}
+
+func (cm *CreditManager) SetUserMaxTokens(userID string, maxTokens int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.getOrCreateUser(userID).MaxTokens = maxTokens
+	cm.saveToFile()
+}
+
+// SetUserPersona selects a named persona for the user. An empty name clears it.
+func (cm *CreditManager) SetUserPersona(userID string, persona string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	user := cm.getOrCreateUser(userID)
+	user.Persona = persona
+	user.CustomPrompt = ""
+	cm.saveToFile()
+}
+
+// SetUserPrompt sets a custom system prompt for the user. An empty prompt clears it.
+func (cm *CreditManager) SetUserPrompt(userID string, prompt string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	user := cm.getOrCreateUser(userID)
+	user.Persona = ""
+	user.CustomPrompt = prompt
+	cm.saveToFile()
+}
+
+func (cm *CreditManager) GetUserPreferences(userID string) UserPreferences {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	user, exists := cm.users[userID]
+	if !exists {
+		return UserPreferences{}
+	}
+	return UserPreferences{
+		Model:        user.Model,
+		Temperature:  user.Temperature,
+		MaxTokens:    user.MaxTokens,
+		Persona:      user.Persona,
+		CustomPrompt: user.CustomPrompt,
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"log"
+
+	"rakka/core/llm"
+)
+
+// imagineCommand generates an image from the prompt and uploads it.
+func imagineCommand(ctx CommandContext) error {
+	b := ctx.Bot
+	msg := &ctx.Msg
+
+	prompt := ctx.RawArgs(0)
+	if prompt == "" {
+		return ctx.Reply("Usage: `imagine <prompt>`")
+	}
+
+	gen, ok := b.LLM.(llm.ImageGenerator)
+	if !ok || gen.ImageModel() == "" {
+		return ctx.Reply("Image generation is not configured.")
+	}
+
+	cost := b.UserCredits.ImageCost()
+	if !b.UserCredits.CanAfford(msg.UserID, b.LLM.ID(), cost) {
+		return ctx.Reply(b.denyOverLimit(msg, "image"))
+	}
+
+	b.react(msg, ctx.Responder, "🎨")
+
+	// the user's model choice is a text model, so only the key carries over
+	reqCfg := b.requestConfig(msg)
+	reqCfg.Model = gen.ImageModel()
+
+	stopTyping := ctx.Responder.StartTyping(msg.ChatID)
+	image, err := gen.GenerateImage(prompt, reqCfg)
+	stopTyping()
+	if err != nil {
+		// failed generations aren't charged
+		b.auditLLM(msg, "image", reqCfg, 0, err)
+		log.Printf("Image generation error: %v", err)
+		return ctx.Reply("I couldn't generate that image.")
+	}
+	b.auditLLM(msg, "image", reqCfg, cost, nil)
+	b.UserCredits.RecordUsage(msg.UserID, b.LLM.ID(), cost)
+
+	name := "image" + imageExtension(image.MimeType)
+	caption := "🎨 " + truncateRunes(prompt, 200)
+	if err := ctx.SendMedia(Attachment{Name: name, MimeType: image.MimeType, Data: image.Data, Caption: caption}); err != nil {
+		return err
+	}
+	b.react(msg, ctx.Responder, "✅")
+	return nil
+}
+
+func imageExtension(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ".png"
+	}
+}
@@ -10,6 +10,11 @@ type Config struct {
 	APIKey   string `toml:"api_key"`
 	BaseURL  string `toml:"base_url"`
 	Model    string `toml:"model"`
+	// model for the imagine command, e.g. gemini-2.5-flash-image or gpt-image-1
+	ImageModel string `toml:"image_model"`
+	// model for transcribing audio, e.g. whisper-1; Gemini uses the chat
+	// model when empty
+	TranscriptionModel string `toml:"transcription_model"`
 }
 
 func New(cfg Config) (Provider, error) {
@@ -19,6 +24,10 @@ func New(cfg Config) (Provider, error) {
 			cfg.BaseURL = "https://generativelanguage.googleapis.com/v1beta"
 		case "openai":
 			cfg.BaseURL = "https://api.openai.com/v1"
+		case "deepseek":
+			cfg.BaseURL = "https://api.deepseek.com/v1"
+		case "ollama":
+			cfg.BaseURL = "http://localhost:11434/v1"
 		}
 	}
 
@@ -27,15 +36,20 @@ func New(cfg Config) (Provider, error) {
 	switch cfg.Provider {
 	case "gemini":
 		return &GeminiProvider{
-			APIKey:  cfg.APIKey,
-			BaseURL: cfg.BaseURL,
-			Model:   cfg.Model,
+			APIKey:               cfg.APIKey,
+			BaseURL:              cfg.BaseURL,
+			Model:                cfg.Model,
+			ImageModelID:         cfg.ImageModel,
+			TranscriptionModelID: cfg.TranscriptionModel,
 		}, nil
 	case "openai", "deepseek", "ollama":
 		return &OpenAIProvider{
-			APIKey:  cfg.APIKey,
-			BaseURL: cfg.BaseURL,
-			Model:   cfg.Model,
+			Name:                 cfg.Provider,
+			APIKey:               cfg.APIKey,
+			BaseURL:              cfg.BaseURL,
+			Model:                cfg.Model,
+			ImageModelID:         cfg.ImageModel,
+			TranscriptionModelID: cfg.TranscriptionModel,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown LLM provider: %s", cfg.Provider)
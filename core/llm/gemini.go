@@ -13,15 +13,24 @@ import (
 var keyRedactor = regexp.MustCompile(`(key=)[^&"\s]+`)
 
 type GeminiProvider struct {
-	APIKey  string
-	BaseURL string
-	Model   string
+	APIKey       string
+	BaseURL      string
+	Model        string
+	ImageModelID string
+	// TranscriptionModelID overrides the chat model for Transcribe.
+	TranscriptionModelID string
 }
 
-var _ Provider = (*GeminiProvider)(nil)
+var (
+	_ Provider       = (*GeminiProvider)(nil)
+	_ ImageGenerator = (*GeminiProvider)(nil)
+	_ Transcriber    = (*GeminiProvider)(nil)
+)
 
 func (g *GeminiProvider) ID() string { return "gemini" }
 
+func (g *GeminiProvider) DefaultModel() string { return g.Model }
+
 type geminiRequest struct {
 	Contents         []geminiContent         `json:"contents"`
 	GenerationConfig *geminiGenerationConfig `json:"generationConfig,omitempty"`
@@ -43,8 +52,9 @@ type geminiInlineData struct {
 }
 
 type geminiGenerationConfig struct {
-	Temperature     float32 `json:"temperature,omitempty"`
-	MaxOutputTokens int     `json:"maxOutputTokens,omitempty"`
+	Temperature        *float32 `json:"temperature,omitempty"`
+	MaxOutputTokens    int      `json:"maxOutputTokens,omitempty"`
+	ResponseModalities []string `json:"responseModalities,omitempty"`
 }
 
 type geminiTool struct {
@@ -66,29 +76,35 @@ type geminiResponse struct {
 }
 
 func (g *GeminiProvider) GenerateText(prompt string, cfg RequestConfig) (string, int, error) {
-	return g.generateInternal(prompt, nil, "", cfg)
+	return g.generateInternal(prompt, nil, cfg)
 }
 
-func (g *GeminiProvider) GenerateVision(prompt string, imageData []byte, mimeType string, cfg RequestConfig) (string, int, error) {
-	return g.generateInternal(prompt, imageData, mimeType, cfg)
+func (g *GeminiProvider) GenerateWithFiles(prompt string, files []File, cfg RequestConfig) (string, int, error) {
+	return g.generateInternal(prompt, files, cfg)
 }
 
-func (g *GeminiProvider) generateInternal(prompt string, imageData []byte, mimeType string, cfg RequestConfig) (string, int, error) {
+func (g *GeminiProvider) generateInternal(prompt string, files []File, cfg RequestConfig) (string, int, error) {
 	apiKey := g.APIKey
 	if cfg.UserKeyOverride != "" {
 		apiKey = cfg.UserKeyOverride
 	}
 
-	fullPrompt := cfg.SystemPrompt + "\n\n" + prompt
+	fullPrompt := prompt
+	if cfg.SystemPrompt != "" {
+		fullPrompt = cfg.SystemPrompt + "\n\n" + prompt
+	}
 
 	var parts []geminiPart
 
-	if imageData != nil && len(imageData) > 0 {
-		encodedImage := base64.StdEncoding.EncodeToString(imageData)
+	// images, PDFs, text and audio are all sent inline
+	for _, file := range files {
+		if len(file.Data) == 0 {
+			continue
+		}
 		parts = append(parts, geminiPart{
 			InlineData: &geminiInlineData{
-				MimeType: mimeType,
-				Data:     encodedImage,
+				MimeType: file.MimeType,
+				Data:     base64.StdEncoding.EncodeToString(file.Data),
 			},
 		})
 	}
@@ -118,7 +134,12 @@ func (g *GeminiProvider) generateInternal(prompt string, imageData []byte, mimeT
 		return "", 0, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", g.BaseURL, g.Model, apiKey)
+	model := g.Model
+	if cfg.Model != "" {
+		model = cfg.Model
+	}
+
+	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", g.BaseURL, model, apiKey)
 
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
@@ -162,3 +183,115 @@ func (g *GeminiProvider) generateInternal(prompt string, imageData []byte, mimeT
 
 	return candidate.Content.Parts[0].Text, tokens, nil
 }
+
+const transcriptionPrompt = "Transcribe this audio verbatim in its original language. Reply with the transcript only, without any comments."
+
+// Transcribe sends the audio inline with an instruction to transcribe it,
+// ignoring the persona and search settings.
+func (g *GeminiProvider) Transcribe(audio File, cfg RequestConfig) (string, int, error) {
+	cfg.SystemPrompt = ""
+	cfg.UseSearch = false
+	if g.TranscriptionModelID != "" {
+		cfg.Model = g.TranscriptionModelID
+	}
+	return g.generateInternal(transcriptionPrompt, []File{audio}, cfg)
+}
+
+func (g *GeminiProvider) ValidateKey(apiKey string) error {
+	url := fmt.Sprintf("%s/models?pageSize=1&key=%s", g.BaseURL, apiKey)
+
+	resp, err := keyCheckClient.Get(url)
+	if err != nil {
+		safeErr := keyRedactor.ReplaceAllString(err.Error(), "$1[REDACTED]")
+		return fmt.Errorf("API connection failed: %s", safeErr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API error %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (g *GeminiProvider) ImageModel() string { return g.ImageModelID }
+
+func (g *GeminiProvider) GenerateImage(prompt string, cfg RequestConfig) (*GeneratedImage, error) {
+	model := g.ImageModelID
+	if cfg.Model != "" {
+		model = cfg.Model
+	}
+	if model == "" {
+		return nil, ErrImageGenerationDisabled
+	}
+
+	apiKey := g.APIKey
+	if cfg.UserKeyOverride != "" {
+		apiKey = cfg.UserKeyOverride
+	}
+
+	reqBody := geminiRequest{
+		Contents: []geminiContent{
+			{Parts: []geminiPart{{Text: prompt}}},
+		},
+		GenerationConfig: &geminiGenerationConfig{
+			ResponseModalities: []string{"TEXT", "IMAGE"},
+		},
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", g.BaseURL, model, apiKey)
+
+	resp, err := mediaClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		safeErr := keyRedactor.ReplaceAllString(err.Error(), "$1[REDACTED]")
+		return nil, fmt.Errorf("API connection failed: %s", safeErr)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var geminiResp geminiResponse
+	if err := json.Unmarshal(body, &geminiResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if len(geminiResp.Candidates) == 0 {
+		return nil, fmt.Errorf("no response candidates")
+	}
+
+	candidate := geminiResp.Candidates[0]
+	image := &GeneratedImage{}
+	for _, part := range candidate.Content.Parts {
+		if part.InlineData == nil {
+			image.Text += part.Text
+			continue
+		}
+		if image.Data != nil {
+			continue
+		}
+		image.Data, err = base64.StdEncoding.DecodeString(part.InlineData.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+		image.MimeType = part.InlineData.MimeType
+	}
+
+	if image.Data == nil {
+		if candidate.FinishReason != "" && candidate.FinishReason != "STOP" {
+			return nil, fmt.Errorf("blocked by safety settings (%s)", candidate.FinishReason)
+		}
+		return nil, fmt.Errorf("model returned no image")
+	}
+	return image, nil
+}
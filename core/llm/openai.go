@@ -2,21 +2,39 @@ package llm
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"strings"
 )
 
 type OpenAIProvider struct {
-	APIKey  string
-	BaseURL string
-	Model   string
+	Name         string
+	APIKey       string
+	BaseURL      string
+	Model        string
+	ImageModelID string
+	// TranscriptionModelID defaults to whisper-1.
+	TranscriptionModelID string
 }
 
-var _ Provider = (*OpenAIProvider)(nil)
+var (
+	_ Provider       = (*OpenAIProvider)(nil)
+	_ ImageGenerator = (*OpenAIProvider)(nil)
+	_ Transcriber    = (*OpenAIProvider)(nil)
+)
+
+func (o *OpenAIProvider) ID() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return "openai"
+}
 
-func (o *OpenAIProvider) ID() string { return "openai" }
+func (o *OpenAIProvider) DefaultModel() string { return o.Model }
 
 type openAIMessage struct {
 	Role    string `json:"role"`
@@ -26,7 +44,7 @@ type openAIMessage struct {
 type openAIRequest struct {
 	Model       string          `json:"model"`
 	Messages    []openAIMessage `json:"messages"`
-	Temperature float32         `json:"temperature"`
+	Temperature *float32        `json:"temperature,omitempty"`
 	MaxTokens   int             `json:"max_tokens"`
 }
 
@@ -54,8 +72,13 @@ func (o *OpenAIProvider) GenerateText(prompt string, cfg RequestConfig) (string,
 	}
 	messages = append(messages, openAIMessage{Role: "user", Content: prompt})
 
+	model := o.Model
+	if cfg.Model != "" {
+		model = cfg.Model
+	}
+
 	reqBody := openAIRequest{
-		Model:       o.Model,
+		Model:       model,
 		Messages:    messages,
 		Temperature: cfg.Temperature,
 		MaxTokens:   cfg.MaxTokens,
@@ -90,8 +113,201 @@ func (o *OpenAIProvider) GenerateText(prompt string, cfg RequestConfig) (string,
 	return result.Choices[0].Message.Content, result.Usage.TotalTokens, nil
 }
 
-func (o *OpenAIProvider) GenerateVision(prompt string, data []byte, mime string, cfg RequestConfig) (string, int, error) {
-	// OpenAI Vision implementation requires Base64 URL format
-	// Implementation omitted for brevity, but follows similar pattern to Text
-	return "OpenAI Vision Not Implemented Yet", 0, nil
+// GenerateWithFiles supports text files, which are added to the prompt,
+// and audio, which is transcribed first.
+func (o *OpenAIProvider) GenerateWithFiles(prompt string, files []File, cfg RequestConfig) (string, int, error) {
+	var sb strings.Builder
+	for _, file := range files {
+		switch {
+		case strings.HasPrefix(file.MimeType, "text/"):
+			sb.WriteString(fmt.Sprintf("File %s:\n```\n%s\n```\n\n", file.Name, file.Data))
+		case strings.HasPrefix(file.MimeType, "audio/"):
+			transcript, _, err := o.Transcribe(file, cfg)
+			if err != nil {
+				return "", 0, fmt.Errorf("failed to transcribe %s: %w", file.Name, err)
+			}
+			sb.WriteString(fmt.Sprintf("Transcript of the audio file %s:\n%s\n\n", file.Name, transcript))
+		default:
+			return "", 0, &UnsupportedFileError{Provider: o.ID(), MimeType: file.MimeType}
+		}
+	}
+	sb.WriteString(prompt)
+	return o.GenerateText(sb.String(), cfg)
+}
+
+// Transcribe uses the Whisper-compatible /audio/transcriptions endpoint.
+func (o *OpenAIProvider) Transcribe(audio File, cfg RequestConfig) (string, int, error) {
+	apiKey := o.APIKey
+	if cfg.UserKeyOverride != "" {
+		apiKey = cfg.UserKeyOverride
+	}
+	model := o.TranscriptionModelID
+	if model == "" {
+		model = "whisper-1"
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("model", model); err != nil {
+		return "", 0, err
+	}
+	part, err := form.CreateFormFile("file", audio.Name)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := part.Write(audio.Data); err != nil {
+		return "", 0, err
+	}
+	if err := form.Close(); err != nil {
+		return "", 0, err
+	}
+
+	req, err := http.NewRequest("POST", o.BaseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", 0, fmt.Errorf("OpenAI Error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		Text  string `json:"text"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", 0, err
+	}
+	return result.Text, result.Usage.TotalTokens, nil
+}
+
+func (o *OpenAIProvider) ValidateKey(apiKey string) error {
+	req, err := http.NewRequest("GET", o.BaseURL+"/models", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := keyCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("OpenAI Error %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type openAIImageRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	N      int    `json:"n"`
+}
+
+type openAIImageResponse struct {
+	Data []struct {
+		B64JSON       string `json:"b64_json"`
+		URL           string `json:"url"`
+		RevisedPrompt string `json:"revised_prompt"`
+	} `json:"data"`
+}
+
+func (o *OpenAIProvider) ImageModel() string { return o.ImageModelID }
+
+func (o *OpenAIProvider) GenerateImage(prompt string, cfg RequestConfig) (*GeneratedImage, error) {
+	model := o.ImageModelID
+	if cfg.Model != "" {
+		model = cfg.Model
+	}
+	if model == "" {
+		return nil, ErrImageGenerationDisabled
+	}
+
+	apiKey := o.APIKey
+	if cfg.UserKeyOverride != "" {
+		apiKey = cfg.UserKeyOverride
+	}
+
+	jsonData, err := json.Marshal(openAIImageRequest{Model: model, Prompt: prompt, N: 1})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequest("POST", o.BaseURL+"/images/generations", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("OpenAI Error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result openAIImageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("empty response from OpenAI")
+	}
+
+	// gpt-image models always return base64, DALL-E returns a URL by default
+	img := result.Data[0]
+	var data []byte
+	if img.B64JSON != "" {
+		data, err = base64.StdEncoding.DecodeString(img.B64JSON)
+	} else {
+		data, err = downloadImage(img.URL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generated image: %w", err)
+	}
+
+	return &GeneratedImage{
+		Data:     data,
+		MimeType: http.DetectContentType(data),
+		Text:     img.RevisedPrompt,
+	}, nil
+}
+
+// downloadImage fetches a generated image from the URL the provider
+// returned, refusing anything larger than an attachment may be.
+func downloadImage(url string) ([]byte, error) {
+	resp, err := mediaClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("image download failed with status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, fmt.Errorf("image is larger than %d MB", maxImageSize>>20)
+	}
+	return data, nil
 }
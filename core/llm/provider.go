@@ -1,7 +1,26 @@
 package llm
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// keyCheckClient validates API keys. A key check is a single small request,
+// so a hung upstream shouldn't block the command that asked for it.
+var keyCheckClient = &http.Client{Timeout: 15 * time.Second}
+
+// maxImageSize bounds downloaded images, the same as core.MaxAttachmentSize.
+const maxImageSize = 10 * 1024 * 1024
+
+// mediaClient sends uploads and media requests, which take longer than a
+// key check but shouldn't leave a command waiting forever.
+var mediaClient = &http.Client{Timeout: 3 * time.Minute}
+
 type RequestConfig struct {
-	Temperature     float32
+	Model           string   // overrides the provider's default model when set
+	Temperature     *float32 // nil leaves it to the provider
 	MaxTokens       int
 	SystemPrompt    string
 	UseSearch       bool
@@ -11,7 +30,57 @@ type RequestConfig struct {
 type Provider interface {
 	ID() string
 
+	// DefaultModel is the model used when RequestConfig.Model is empty.
+	DefaultModel() string
+
 	GenerateText(prompt string, config RequestConfig) (string, int, error)
 
-	GenerateVision(prompt string, imageData []byte, mimeType string, config RequestConfig) (string, int, error)
+	// GenerateWithFiles answers prompt about the attached files, e.g.
+	// images, PDFs, text files or audio.
+	GenerateWithFiles(prompt string, files []File, config RequestConfig) (string, int, error)
+
+	// ValidateKey makes a cheap authenticated call to check that apiKey is accepted.
+	ValidateKey(apiKey string) error
+}
+
+// File is an attachment sent to the model along with the prompt.
+type File struct {
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
+// Transcriber is implemented by providers that can turn speech into text.
+// The token count is zero if the endpoint doesn't report usage.
+type Transcriber interface {
+	Transcribe(audio File, config RequestConfig) (string, int, error)
+}
+
+// ErrImageGenerationDisabled is returned when no image model is configured.
+var ErrImageGenerationDisabled = errors.New("image generation is not configured")
+
+// UnsupportedFileError is returned by GenerateWithFiles for a file type
+// the provider can't read.
+type UnsupportedFileError struct {
+	Provider string
+	MimeType string
+}
+
+func (e *UnsupportedFileError) Error() string {
+	return fmt.Sprintf("%s attachments are not supported by %s", e.MimeType, e.Provider)
+}
+
+type GeneratedImage struct {
+	Data     []byte
+	MimeType string
+	Text     string // text the model returned alongside the image, if any
+}
+
+// ImageGenerator is implemented by providers that can create images.
+// RequestConfig.Model overrides the image model.
+type ImageGenerator interface {
+	// ImageModel is empty when image generation is not configured.
+	ImageModel() string
+
+	GenerateImage(prompt string, config RequestConfig) (*GeneratedImage, error)
 }
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"rakka/modules"
+)
+
+// Markdown renders msg for platforms without native cards. Command buttons
+// become a hint showing the command with the given prefix, e.g. "!bot".
+func (msg *OutgoingMessage) Markdown(commandPrefix string) string {
+	var sb strings.Builder
+	if msg.Text != "" {
+		sb.WriteString(msg.Text + "\n\n")
+	}
+
+	switch {
+	case msg.Title != "" && msg.URL != "":
+		sb.WriteString(fmt.Sprintf("### [%s](%s)\n", msg.Title, msg.URL))
+	case msg.Title != "":
+		sb.WriteString("### " + msg.Title + "\n")
+	}
+	if msg.Description != "" {
+		sb.WriteString(msg.Description + "\n\n")
+	}
+	for _, f := range msg.Fields {
+		sb.WriteString(fmt.Sprintf("**%s:** %s\n", f.Name, f.Value))
+	}
+
+	var links []string
+	for _, button := range msg.Buttons {
+		if button.URL != "" {
+			links = append(links, fmt.Sprintf("[%s](%s)", button.Label, button.URL))
+		} else if button.Command != "" {
+			links = append(links, fmt.Sprintf("%s: `%s %s`", button.Label, commandPrefix, button.Command))
+		}
+	}
+	if len(links) > 0 {
+		sb.WriteString("\n" + strings.Join(links, " · ") + "\n")
+	}
+
+	if msg.Footer != "" {
+		sb.WriteString("\n_" + msg.Footer + "_")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// SendRich sends msg as a reply to the triggering message.
+func (ctx CommandContext) SendRich(msg *OutgoingMessage) error {
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = ctx.Msg.MessageID
+	}
+	return ctx.Responder.SendRich(ctx.Msg.ChatID, msg)
+}
+
+// SendMedia uploads media as a reply to the triggering message.
+func (ctx CommandContext) SendMedia(media Attachment) error {
+	return ctx.Responder.SendMedia(ctx.Msg.ChatID, ctx.Msg.MessageID, media)
+}
+
+const aniListColor = 0x02A9FF
+
+func animeCard(info *modules.MediaInfo) *OutgoingMessage {
+	card := mediaCard("🎬", info,
+		Field{Name: "Episodes", Value: countOrUnknown(info.Episodes), Inline: true},
+	)
+	card.Buttons = append(card.Buttons, Button{Label: "Find manga", Command: "manga " + info.Title})
+	return card
+}
+
+func mangaCard(info *modules.MediaInfo) *OutgoingMessage {
+	card := mediaCard("📖", info,
+		Field{Name: "Volumes", Value: countOrUnknown(info.Volumes), Inline: true},
+		Field{Name: "Chapters", Value: countOrUnknown(info.Chapters), Inline: true},
+	)
+	card.Buttons = append(card.Buttons, Button{Label: "Find anime", Command: "anime " + info.Title})
+	return card
+}
+
+// mediaCard builds the card shared by anime and manga, with the
+// type-specific counts placed after score and status.
+func mediaCard(icon string, info *modules.MediaInfo, counts ...Field) *OutgoingMessage {
+	card := &OutgoingMessage{
+		Title:       icon + " " + info.Title,
+		URL:         info.SiteURL,
+		Description: info.Description,
+		Thumbnail:   info.CoverImage,
+		Color:       aniListColor,
+		Footer:      "Data from AniList",
+		Fields: []Field{
+			{Name: "Score", Value: fmt.Sprintf("%d/100", info.AverageScore), Inline: true},
+			{Name: "Status", Value: info.Status, Inline: true},
+		},
+		Buttons: []Button{{Label: "View on AniList", URL: info.SiteURL}},
+	}
+	card.Fields = append(card.Fields, counts...)
+	if len(info.Genres) > 0 {
+		card.Fields = append(card.Fields, Field{Name: "Genres", Value: strings.Join(info.Genres, ", ")})
+	}
+	return card
+}
+
+func countOrUnknown(n int) string {
+	if n <= 0 {
+		return "?"
+	}
+	return fmt.Sprint(n)
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+type RoomsConfig struct {
+	FilePath string `toml:"file_path"`
+}
+
+type RoomSettings struct {
+	RoomID       string `json:"room_id"`
+	Persona      string `json:"persona,omitempty"`
+	CustomPrompt string `json:"custom_prompt,omitempty"`
+}
+
+type RoomManager struct {
+	mu       sync.RWMutex
+	rooms    map[string]*RoomSettings
+	filePath string
+}
+
+func NewRoomManager(cfg RoomsConfig) *RoomManager {
+	rm := &RoomManager{
+		rooms:    make(map[string]*RoomSettings),
+		filePath: cfg.FilePath,
+	}
+	rm.loadFromFile()
+	return rm
+}
+
+func (rm *RoomManager) loadFromFile() {
+	if rm.filePath == "" {
+		return
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	data, err := os.ReadFile(rm.filePath)
+	if err != nil {
+		return
+	}
+
+	if err := json.Unmarshal(data, &rm.rooms); err != nil {
+		log.Printf("Failed to parse rooms file: %v", err)
+	}
+}
+
+func (rm *RoomManager) saveToFile() {
+	if rm.filePath == "" {
+		return
+	}
+
+	data, err := json.Marshal(rm.rooms)
+	if err != nil {
+		log.Printf("Failed to marshal rooms: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(rm.filePath, data, 0600); err != nil {
+		log.Printf("Failed to save rooms file: %v", err)
+	}
+}
+
+func (rm *RoomManager) getOrCreateRoom(roomID string) *RoomSettings {
+	if rm.rooms[roomID] == nil {
+		rm.rooms[roomID] = &RoomSettings{RoomID: roomID}
+	}
+	return rm.rooms[roomID]
+}
+
+// SetRoomPersona selects a named persona for the room. An empty name clears it.
+func (rm *RoomManager) SetRoomPersona(roomID string, persona string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	room := rm.getOrCreateRoom(roomID)
+	room.Persona = persona
+	room.CustomPrompt = ""
+	rm.saveToFile()
+}
+
+// SetRoomPrompt sets a custom system prompt for the room. An empty prompt clears it.
+func (rm *RoomManager) SetRoomPrompt(roomID string, prompt string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	room := rm.getOrCreateRoom(roomID)
+	room.Persona = ""
+	room.CustomPrompt = prompt
+	rm.saveToFile()
+}
+
+func (rm *RoomManager) GetRoomSettings(roomID string) RoomSettings {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	room, exists := rm.rooms[roomID]
+	if !exists {
+		return RoomSettings{RoomID: roomID}
+	}
+	return *room
+}
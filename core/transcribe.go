@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"rakka/core/llm"
+)
+
+// transcribeCommand writes down the voice messages or audio files attached
+// to the command or to the message it replies to.
+func transcribeCommand(ctx CommandContext) error {
+	b := ctx.Bot
+	msg := &ctx.Msg
+
+	if problem := msg.attachmentProblem(); problem != "" {
+		return ctx.Reply(problem)
+	}
+	audio := msg.audioAttachments()
+	if len(audio) == 0 {
+		return ctx.Reply("Reply to a voice message or audio file with `transcribe`.")
+	}
+
+	transcriber, ok := b.LLM.(llm.Transcriber)
+	if !ok {
+		return ctx.Reply("Transcription is not supported by the current provider.")
+	}
+
+	if !b.UserCredits.CanUseAPI(msg.UserID, b.LLM.ID()) {
+		return ctx.Reply(b.denyOverLimit(msg, "transcribe"))
+	}
+	cost, problem := b.checkAudio(msg)
+	if problem != "" {
+		return ctx.Reply(problem)
+	}
+
+	b.react(msg, ctx.Responder, "🎧")
+
+	// transcripts are verbatim, so the user's model and persona don't apply
+	reqCfg := b.requestConfig(msg)
+	reqCfg.Model = ""
+
+	stopTyping := ctx.Responder.StartTyping(msg.ChatID)
+	defer stopTyping()
+
+	var sb strings.Builder
+	tokens := 0
+	for _, att := range audio {
+		text, used, err := transcriber.Transcribe(llm.File{Name: att.Name, MimeType: att.MimeType, Data: att.Data}, reqCfg)
+		tokens += used
+		if err != nil {
+			// earlier files were transcribed, and are paid for
+			b.auditLLM(msg, "transcribe", reqCfg, tokens, err)
+			b.UserCredits.RecordUsage(msg.UserID, b.LLM.ID(), tokens)
+			log.Printf("Transcription error: %v", err)
+			return ctx.Reply("I couldn't transcribe that.")
+		}
+		if len(audio) > 1 {
+			sb.WriteString(fmt.Sprintf("**%s**\n", att.Name))
+		}
+		sb.WriteString(strings.TrimSpace(text) + "\n\n")
+	}
+
+	if cost > tokens {
+		tokens = cost
+	}
+	b.auditLLM(msg, "transcribe", reqCfg, tokens, nil)
+	b.UserCredits.RecordUsage(msg.UserID, b.LLM.ID(), tokens)
+
+	stopTyping()
+	if err := ctx.Reply("🎙️ " + strings.TrimSpace(sb.String())); err != nil {
+		return err
+	}
+	b.react(msg, ctx.Responder, "✅")
+	return nil
+}
@@ -1,19 +1,88 @@
 package core
 
+import "time"
+
 type IncomingMessage struct {
-	Platform      string
-	UserID        string
-	UserName      string
-	ChatID        string
-	Content       string
-	IsImage       bool
-	ImageData     []byte
-	ImageMimeType string
-	ReplyTo       *IncomingMessage
+	Platform        string
+	MessageID       string
+	ReplyToID       string // ID of the message this one replies to, if any
+	ThreadID        string // ID of the thread (root message or thread channel), if any
+	UserID          string
+	UserName        string
+	ChatID          string
+	Content         string
+	IsDirectMessage bool
+	IsMention       bool         // the platform says the bot was mentioned or replied to
+	Attachments     []Attachment // supported files of the message, or of the one it replies to
+	// files that couldn't be downloaded or used; the user is told instead
+	// of getting an answer that ignores them
+	AttachmentErrors []error
+	ReplyTo          *IncomingMessage // the replied-to message's author and text, quoted in the prompt
+	// persona of the bot account that was addressed, where a platform has
+	// one account per persona
+	Persona string
 }
 
 type Responder interface {
 	SendText(chatID string, text string) error
 	ReplyText(chatID string, originalMsgID string, text string) error
+	// SendRich sends a structured message, e.g. a card with an image.
+	SendRich(chatID string, msg *OutgoingMessage) error
+	// SendMedia uploads an image or file, replying to replyToID if set.
+	SendMedia(chatID string, replyToID string, media Attachment) error
 	SendReaction(chatID string, messageID string, emoji string) error
+	// StartTyping shows a typing indicator in the chat until stop is called.
+	StartTyping(chatID string) (stop func())
+	// DeleteMessage removes a message, e.g. one that leaked a secret.
+	DeleteMessage(chatID string, messageID string) error
+	// OpenDirectChat returns the ID of a 1:1 chat with the user, creating it if needed.
+	OpenDirectChat(userID string) (string, error)
+}
+
+// DeviceVerifier is implemented by responders that can verify their device
+// with an admin, like Matrix with E2EE.
+type DeviceVerifier interface {
+	// CanVerify reports whether verification is set up.
+	CanVerify() bool
+	VerifyCommand(ctx CommandContext) error
+}
+
+// OutgoingMessage is a structured message such as an info card. Platforms
+// render what they support; everything is optional.
+type OutgoingMessage struct {
+	Text        string // Markdown shown above the card
+	Title       string
+	URL         string // link on the title
+	Description string
+	Fields      []Field
+	Thumbnail   string // URL of a small image shown beside the card
+	Image       string // URL of a large image shown below the card
+	Footer      string
+	Color       int
+	Files       []Attachment
+	Buttons     []Button
+	ReplyTo     string // ID of the message to reply to
+}
+
+type Field struct {
+	Name   string
+	Value  string
+	Inline bool
+}
+
+type Attachment struct {
+	Name     string
+	MimeType string
+	Data     []byte
+	Caption  string        // optional text shown with the file
+	Duration time.Duration // length of audio, if the platform reports it
+}
+
+// Button either opens URL or, where the platform supports it, runs Command
+// (a bot command without the prefix, e.g. "manga Berserk") as the user who
+// pressed it.
+type Button struct {
+	Label   string
+	URL     string
+	Command string
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -20,6 +21,13 @@ func main() {
 	var configPath string
 	flag.StringVar(&configPath, "config", "config.toml", "Path to config file")
 	flag.StringVar(&configPath, "c", "config.toml", "Path to config file (shorthand)")
+	var bootstrapCrossSigning bool
+	flag.BoolVar(&bootstrapCrossSigning, "bootstrap-cross-signing", false, "Set up Matrix cross-signing for the bot's device and exit")
+	var logout, relogin bool
+	flag.BoolVar(&logout, "logout", false, "Log the Matrix bot out, remove its stored session and exit")
+	flag.BoolVar(&relogin, "relogin", false, "Log the Matrix bot out and log in again as a new device")
+	var generateRegistration bool
+	flag.BoolVar(&generateRegistration, "generate-registration", false, "Write the Matrix appservice registration file and exit")
 	flag.Parse()
 
 	// load config
@@ -28,24 +36,74 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if bootstrapCrossSigning {
+		if err := runCrossSigningBootstrap(&cfg.Matrix); err != nil {
+			log.Fatalf("Cross-signing bootstrap failed: %v", err)
+		}
+		return
+	}
+	if logout || relogin {
+		passphrase, err := matrix.GetPassphrase(&cfg.Matrix)
+		if err != nil {
+			log.Fatalf("Failed to get Matrix passphrase: %v", err)
+		}
+		if err := matrix.Logout(&cfg.Matrix, passphrase); err != nil {
+			log.Fatalf("Logout failed: %v", err)
+		}
+		if logout {
+			return
+		}
+	}
+	if generateRegistration {
+		if err := matrix.GenerateRegistration(&cfg.Matrix); err != nil {
+			log.Fatalf("Failed to generate registration: %v", err)
+		}
+		return
+	}
+
 	// initialize core
 	credits := core.NewCreditManager(cfg.Credits)
 	defer credits.ForceSave()
 
+	audit, err := core.NewAuditLog(cfg.Audit)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer audit.Close()
+
+	rooms := core.NewRoomManager(cfg.Rooms)
 	ctxMgr := core.NewContextManager(cfg.Bot.MaxHistory)
 
 	llmProvider, err := llm.New(cfg.LLM)
 	if err != nil {
 		log.Fatalf("Failed to init LLM: %v", err)
 	}
+	credits.MigrateLegacyKeys(llmProvider.ID())
 
-	brain := core.NewBot(llmProvider, &cfg.Bot, credits, ctxMgr)
+	brain := core.NewBot(llmProvider, &cfg.Bot, credits, rooms, ctxMgr, audit)
 	core.RegisterDefaultCommands(brain)
 
 	// initialize matrix platform
-	if cfg.Matrix.UserID != "" {
+	if cfg.Matrix.UserID != "" && cfg.Matrix.Appservice.Enabled {
+		asvc, err := matrix.NewAppservice(brain, &cfg.Bot, &cfg.Matrix)
+		if err != nil {
+			log.Fatalf("Failed to create Matrix appservice: %v", err)
+		}
 		go func() {
-			matrixClient, err := matrix.GetMatrixClient(&cfg.Matrix)
+			log.Println("🚀 Starting Matrix appservice...")
+			if err := asvc.Start(); err != nil {
+				log.Printf("Matrix appservice failed: %v", err)
+			}
+		}()
+	} else if cfg.Matrix.UserID != "" {
+		go func() {
+			passphrase, err := matrix.GetPassphrase(&cfg.Matrix)
+			if err != nil {
+				log.Printf("❌ Failed to get Matrix passphrase: %v", err)
+				return
+			}
+
+			matrixClient, err := matrix.GetMatrixClient(&cfg.Matrix, passphrase)
 			if err != nil {
 				log.Printf("❌ Failed to create Matrix client: %v", err)
 				return
@@ -56,8 +114,9 @@ func main() {
 				log.Printf("❌ Failed to initialize Matrix crypto: %v", err)
 				return
 			}
+			matrix.EnsureCrossSigned(context.Background(), matrixClient, &cfg.Matrix, passphrase)
 
-			adapter := matrix.NewMatrixAdapter(matrixClient, brain, &cfg.Bot, cfg.Matrix.AutoJoinInvites)
+			adapter := matrix.NewMatrixAdapter(matrixClient, brain, &cfg.Bot, &cfg.Matrix)
 			log.Println("🚀 Starting Matrix bot...")
 			if err := adapter.Start(); err != nil {
 				log.Printf("Matrix Bot failed: %v", err)
@@ -85,3 +144,18 @@ func main() {
 
 	log.Println("Shutting down...")
 }
+
+func runCrossSigningBootstrap(cfg *matrix.Config) error {
+	passphrase, err := matrix.GetPassphrase(cfg)
+	if err != nil {
+		return err
+	}
+	client, err := matrix.GetMatrixClient(cfg, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := matrix.InitCrypto(client, cfg.CryptoDBPath, cfg.PickleKey); err != nil {
+		return err
+	}
+	return matrix.BootstrapCrossSigning(context.Background(), client, cfg, passphrase)
+}
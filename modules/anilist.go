@@ -3,75 +3,127 @@ package modules
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 )
 
+// ErrNotFound is returned when a search has no results.
+var ErrNotFound = errors.New("not found")
+
 type AniListRequest struct {
 	Query     string                 `json:"query"`
 	Variables map[string]interface{} `json:"variables"`
 }
 
+// MediaInfo describes an anime or manga entry on AniList. Counts are zero
+// when unknown, e.g. for airing shows.
+type MediaInfo struct {
+	Title        string
+	Description  string
+	AverageScore int
+	Episodes     int
+	Chapters     int
+	Volumes      int
+	Status       string
+	Genres       []string
+	SiteURL      string
+	CoverImage   string
+	BannerImage  string
+}
+
+type aniListMedia struct {
+	Title struct {
+		Romaji  string `json:"romaji"`
+		English string `json:"english"`
+	} `json:"title"`
+	Description  string   `json:"description"`
+	AverageScore int      `json:"averageScore"`
+	Episodes     int      `json:"episodes"`
+	Chapters     int      `json:"chapters"`
+	Volumes      int      `json:"volumes"`
+	Status       string   `json:"status"`
+	Genres       []string `json:"genres"`
+	SiteUrl      string   `json:"siteUrl"`
+	CoverImage   struct {
+		Large string `json:"large"`
+	} `json:"coverImage"`
+	BannerImage string `json:"bannerImage"`
+}
+
 type AniListResponse struct {
 	Data struct {
-		Media struct {
-			Title struct {
-				Romaji  string `json:"romaji"`
-				English string `json:"english"`
-			} `json:"title"`
-			Description  string `json:"description"`
-			AverageScore int    `json:"averageScore"`
-			Episodes     int    `json:"episodes"`
-			Status       string `json:"status"`
-			SiteUrl      string `json:"siteUrl"`
-		} `json:"Media"`
+		Media aniListMedia `json:"Media"`
 	} `json:"data"`
 }
 
-func GetAnimeInfo(search string) (string, error) {
-	query := `
-	query ($search: String) {
-		Media (search: $search, type: ANIME) {
-			title {
-				romaji
-				english
-			}
-			description
-			averageScore
-			episodes
-			status
-			siteUrl
+const aniListQuery = `
+query ($search: String, $type: MediaType) {
+	Media (search: $search, type: $type) {
+		title {
+			romaji
+			english
+		}
+		description
+		averageScore
+		episodes
+		chapters
+		volumes
+		status
+		genres
+		siteUrl
+		coverImage {
+			large
 		}
+		bannerImage
 	}
-	`
+}
+`
 
+var htmlTag = regexp.MustCompile(`<[^>]+>`)
+
+func GetAnimeInfo(search string) (*MediaInfo, error) {
+	return searchAniList(search, "ANIME")
+}
+
+func searchAniList(search string, mediaType string) (*MediaInfo, error) {
 	reqBody := AniListRequest{
-		Query: query,
+		Query: aniListQuery,
 		Variables: map[string]interface{}{
 			"search": search,
+			"type":   mediaType,
 		},
 	}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	resp, err := http.Post("https://graphql.anilist.co", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	// AniList answers unknown titles with 404 and a null Media
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("anilist returned status %d", resp.StatusCode)
+	}
+
 	var result AniListResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	media := result.Data.Media
 	if media.SiteUrl == "" {
-		return "Anime not found.", nil
+		return nil, ErrNotFound
 	}
 
 	title := media.Title.English
@@ -83,12 +135,23 @@ func GetAnimeInfo(search string) (string, error) {
 	desc := strings.ReplaceAll(media.Description, "<br>", "\n")
 	desc = strings.ReplaceAll(desc, "<i>", "_")
 	desc = strings.ReplaceAll(desc, "</i>", "_")
-	if len(desc) > 400 {
-		desc = desc[:397] + "..."
+	desc = htmlTag.ReplaceAllString(desc, "")
+	desc = strings.TrimSpace(desc)
+	if r := []rune(desc); len(r) > 400 {
+		desc = string(r[:397]) + "..."
 	}
 
-	output := fmt.Sprintf("🎬 **%s**\nScore: %d/100 | Eps: %d | Status: %s\n\n%s\n\n🔗 %s",
-		title, media.AverageScore, media.Episodes, media.Status, desc, media.SiteUrl)
-
-	return output, nil
+	return &MediaInfo{
+		Title:        title,
+		Description:  desc,
+		AverageScore: media.AverageScore,
+		Episodes:     media.Episodes,
+		Chapters:     media.Chapters,
+		Volumes:      media.Volumes,
+		Status:       media.Status,
+		Genres:       media.Genres,
+		SiteURL:      media.SiteUrl,
+		CoverImage:   media.CoverImage.Large,
+		BannerImage:  media.BannerImage,
+	}, nil
 }
@@ -1,11 +1,15 @@
 package discord
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"rakka/core"
@@ -36,6 +40,7 @@ func NewDiscordAdapter(token string, coreBot *core.Bot) (*DiscordAdapter, error)
 
 func (da *DiscordAdapter) Start() error {
 	da.Session.AddHandler(da.handleMessage)
+	da.Session.AddHandler(da.handleInteraction)
 
 	err := da.Session.Open()
 	if err != nil {
@@ -64,41 +69,168 @@ func (da *DiscordAdapter) handleMessage(s *discordgo.Session, m *discordgo.Messa
 
 	// Prepare the Core IncomingMessage
 	incomingMsg := core.IncomingMessage{
-		Platform: "discord",
-		UserID:   m.Author.ID,
-		UserName: m.Author.Username,
-		ChatID:   m.ChannelID,
-		Content:  m.Content,
+		Platform:        "discord",
+		MessageID:       m.ID,
+		UserID:          m.Author.ID,
+		UserName:        m.Author.Username,
+		ChatID:          m.ChannelID,
+		Content:         m.Content,
+		IsDirectMessage: m.GuildID == "",
+	}
+	if m.MessageReference != nil {
+		incomingMsg.ReplyToID = m.MessageReference.MessageID
+		// the gateway usually includes the replied-to message, but not
+		// always, e.g. when it was too old to resolve
+		if m.ReferencedMessage == nil {
+			ref, err := s.ChannelMessage(m.MessageReference.ChannelID, m.MessageReference.MessageID)
+			if err != nil {
+				log.Printf("Failed to fetch referenced discord message: %v", err)
+			} else {
+				m.ReferencedMessage = ref
+			}
+		}
+	}
+	if ref := m.ReferencedMessage; ref != nil && ref.Author != nil {
+		incomingMsg.ReplyTo = &core.IncomingMessage{
+			Platform:  "discord",
+			MessageID: ref.ID,
+			UserID:    ref.Author.ID,
+			UserName:  ref.Author.Username,
+			ChatID:    ref.ChannelID,
+			Content:   messageText(ref),
+		}
+	}
+	// threads are channels of their own, so replies already land in them
+	if da.isThread(m.ChannelID) {
+		incomingMsg.ThreadID = m.ChannelID
 	}
 
-	if strings.Contains(m.Content, "<@"+da.BotID+">") || strings.Contains(m.Content, "<@!"+da.BotID+">") {
+	if da.isMentioned(m.Message) {
+		incomingMsg.IsMention = true
 		incomingMsg.Content = strings.ReplaceAll(incomingMsg.Content, "<@"+da.BotID+">", "")
 		incomingMsg.Content = strings.ReplaceAll(incomingMsg.Content, "<@!"+da.BotID+">", "")
 		incomingMsg.Content = strings.TrimSpace(incomingMsg.Content)
-		incomingMsg.Content = da.Core.Config.Name + " " + incomingMsg.Content
 	}
 
-	// Handle Attachments (Images)
-	if len(m.Attachments) > 0 {
-		att := m.Attachments[0]
-		// Simple check for images
-		if strings.HasSuffix(strings.ToLower(att.Filename), ".png") ||
-			strings.HasSuffix(strings.ToLower(att.Filename), ".jpg") ||
-			strings.HasSuffix(strings.ToLower(att.Filename), ".jpeg") ||
-			strings.HasSuffix(strings.ToLower(att.Filename), ".webp") {
+	// files are only downloaded when the bot is asked about them
+	if da.Core.IsAddressed(&incomingMsg) {
+		da.addAttachments(&incomingMsg, m.Attachments)
+		// e.g. "analyze this" or `transcribe` sent as a reply to a file
+		if len(m.Attachments) == 0 && m.ReferencedMessage != nil {
+			da.addAttachments(&incomingMsg, m.ReferencedMessage.Attachments)
+			da.addEmbedImages(&incomingMsg, m.ReferencedMessage.Embeds)
+		}
+	}
 
-			data, err := da.downloadAttachment(att.URL)
-			if err != nil {
-				log.Printf("Failed to download discord attachment: %v", err)
-			} else {
-				incomingMsg.IsImage = true
-				incomingMsg.ImageData = data
-				incomingMsg.ImageMimeType = "image/jpeg"
+	go da.Core.HandleMessage(incomingMsg, da)
+}
+
+// isMentioned reports whether the message pings the bot, including replies
+// to the bot's own messages.
+func (da *DiscordAdapter) isMentioned(m *discordgo.Message) bool {
+	for _, user := range m.Mentions {
+		if user.ID == da.BotID {
+			return true
+		}
+	}
+	return m.ReferencedMessage != nil && m.ReferencedMessage.Author != nil && m.ReferencedMessage.Author.ID == da.BotID
+}
+
+func (da *DiscordAdapter) isThread(channelID string) bool {
+	ch, err := da.Session.State.Channel(channelID)
+	if err != nil {
+		ch, err = da.Session.Channel(channelID)
+		if err != nil {
+			return false
+		}
+	}
+	return ch.IsThread()
+}
+
+// addAttachments downloads the supported files of a message. Files that
+// are too large according to Discord are skipped without downloading;
+// problems are recorded in msg so the user learns about them.
+func (da *DiscordAdapter) addAttachments(msg *core.IncomingMessage, attachments []*discordgo.MessageAttachment) {
+	for _, att := range attachments {
+		if att.Size > core.MaxAttachmentSize {
+			err := fmt.Errorf("%s: %w, the limit is %d MB", att.Filename, core.ErrAttachmentTooLarge, core.MaxAttachmentSize>>20)
+			log.Printf("Skipping discord attachment: %v", err)
+			msg.AttachmentErrors = append(msg.AttachmentErrors, err)
+			continue
+		}
+		data, err := da.downloadAttachment(att.URL)
+		if err != nil {
+			log.Printf("Failed to download discord attachment: %v", err)
+			msg.AttachmentErrors = append(msg.AttachmentErrors, fmt.Errorf("%s: download failed", att.Filename))
+			continue
+		}
+		err = msg.AddAttachment(core.Attachment{
+			Name:     att.Filename,
+			MimeType: att.ContentType,
+			Data:     data,
+			// only set for voice messages
+			Duration: time.Duration(att.DurationSecs * float64(time.Second)),
+		})
+		if err != nil {
+			log.Printf("Skipping discord attachment: %v", err)
+			msg.AttachmentErrors = append(msg.AttachmentErrors, err)
+		}
+	}
+}
+
+// addEmbedImages adds the images of embeds, such as link previews or the
+// bot's own cards. Like with attachments, problems are recorded in msg.
+func (da *DiscordAdapter) addEmbedImages(msg *core.IncomingMessage, embeds []*discordgo.MessageEmbed) {
+	for _, embed := range embeds {
+		url := ""
+		switch {
+		case embed.Image != nil:
+			url = embed.Image.ProxyURL
+			if url == "" {
+				url = embed.Image.URL
+			}
+		case embed.Thumbnail != nil:
+			url = embed.Thumbnail.ProxyURL
+			if url == "" {
+				url = embed.Thumbnail.URL
 			}
 		}
+		if url == "" {
+			continue
+		}
+
+		name := path.Base(strings.SplitN(url, "?", 2)[0])
+		data, err := da.downloadAttachment(url)
+		if err != nil {
+			log.Printf("Failed to download discord embed image: %v", err)
+			msg.AttachmentErrors = append(msg.AttachmentErrors, fmt.Errorf("%s: download failed", name))
+			continue
+		}
+		if err := msg.AddAttachment(core.Attachment{Name: name, Data: data}); err != nil {
+			log.Printf("Skipping discord embed image: %v", err)
+			msg.AttachmentErrors = append(msg.AttachmentErrors, err)
+		}
 	}
+}
 
-	go da.Core.HandleMessage(incomingMsg, da)
+// messageText returns a message's content followed by the text of its
+// embeds, which is all there is for bot cards.
+func messageText(m *discordgo.Message) string {
+	parts := []string{m.Content}
+	for _, embed := range m.Embeds {
+		parts = append(parts, embed.Title, embed.Description)
+		for _, field := range embed.Fields {
+			parts = append(parts, field.Name+": "+field.Value)
+		}
+	}
+
+	var nonEmpty []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
 }
 
 func (da *DiscordAdapter) downloadAttachment(url string) ([]byte, error) {
@@ -108,34 +240,253 @@ func (da *DiscordAdapter) downloadAttachment(url string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
-	return io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	// Discord reports the size, but don't rely on it
+	return io.ReadAll(io.LimitReader(resp.Body, core.MaxAttachmentSize+1))
 }
 
+// discordMessageLimit is the maximum length of a message's content.
+const discordMessageLimit = 2000
+
 func (da *DiscordAdapter) SendText(chatID string, text string) error {
-	if len(text) > 2000 {
-		text = text[:1990] + "..."
-	}
-	_, err := da.Session.ChannelMessageSend(chatID, text)
-	return err
+	return da.send(chatID, "", text)
 }
 
 func (da *DiscordAdapter) ReplyText(chatID string, originalMsgID string, text string) error {
-	if len(text) > 2000 {
-		text = text[:1990] + "..."
+	return da.send(chatID, originalMsgID, text)
+}
+
+// send splits text into as many messages as needed, replying with the
+// first one if replyToID is set. Very long texts are uploaded as a file.
+func (da *DiscordAdapter) send(chatID string, replyToID string, text string) error {
+	chunks := core.SplitMessage(text, discordMessageLimit)
+	if len(chunks) > da.Core.Config.MessageChunkLimit() {
+		name, mimeType := core.TextAttachment(text)
+		return da.SendMedia(chatID, replyToID, core.Attachment{
+			Name:     name,
+			MimeType: mimeType,
+			Data:     []byte(text),
+			Caption:  core.LongMessageNotice,
+		})
+	}
+
+	for i, chunk := range chunks {
+		msg := &discordgo.MessageSend{Content: chunk}
+		if i == 0 {
+			msg.Reference = replyReference(chatID, replyToID)
+		}
+		if _, err := da.Session.ChannelMessageSendComplex(chatID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discord embed limits, see https://discord.com/developers/docs/resources/message#embed-object-embed-limits
+const (
+	embedTitleLimit       = 256
+	embedDescriptionLimit = 4096
+	embedFieldLimit       = 25
+	embedFieldNameLimit   = 256
+	embedFieldValueLimit  = 1024
+	embedFooterLimit      = 2048
+	buttonsPerRow         = 5
+	buttonLabelLimit      = 80
+	customIDLimit         = 100
+)
+
+// commandButtonPrefix marks button custom IDs that run a bot command.
+const commandButtonPrefix = "cmd:"
+
+func (da *DiscordAdapter) SendRich(chatID string, msg *core.OutgoingMessage) error {
+	send := &discordgo.MessageSend{
+		Content:   truncate(msg.Text, discordMessageLimit),
+		Reference: replyReference(chatID, msg.ReplyTo),
 	}
 
-	ref := &discordgo.MessageReference{
-		MessageID: originalMsgID,
-		ChannelID: chatID,
+	if msg.Title != "" || msg.Description != "" || len(msg.Fields) > 0 || msg.Thumbnail != "" || msg.Image != "" {
+		embed := &discordgo.MessageEmbed{
+			Title:       truncate(msg.Title, embedTitleLimit),
+			URL:         msg.URL,
+			Description: truncate(msg.Description, embedDescriptionLimit),
+			Color:       msg.Color,
+		}
+		for i, f := range msg.Fields {
+			if i == embedFieldLimit {
+				break
+			}
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:   truncate(f.Name, embedFieldNameLimit),
+				Value:  truncate(f.Value, embedFieldValueLimit),
+				Inline: f.Inline,
+			})
+		}
+		if msg.Thumbnail != "" {
+			embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: msg.Thumbnail}
+		}
+		if msg.Image != "" {
+			embed.Image = &discordgo.MessageEmbedImage{URL: msg.Image}
+		}
+		if msg.Footer != "" {
+			embed.Footer = &discordgo.MessageEmbedFooter{Text: truncate(msg.Footer, embedFooterLimit)}
+		}
+		send.Embeds = []*discordgo.MessageEmbed{embed}
 	}
 
+	for _, file := range msg.Files {
+		send.Files = append(send.Files, &discordgo.File{
+			Name:        file.Name,
+			ContentType: file.MimeType,
+			Reader:      bytes.NewReader(file.Data),
+		})
+	}
+
+	var row discordgo.ActionsRow
+	for _, b := range msg.Buttons {
+		button := discordgo.Button{Label: truncate(b.Label, buttonLabelLimit)}
+		switch {
+		case b.URL != "":
+			button.Style = discordgo.LinkButton
+			button.URL = b.URL
+		case b.Command != "" && len(commandButtonPrefix+b.Command) <= customIDLimit:
+			button.Style = discordgo.SecondaryButton
+			button.CustomID = commandButtonPrefix + b.Command
+		default:
+			continue
+		}
+		row.Components = append(row.Components, button)
+		if len(row.Components) == buttonsPerRow {
+			send.Components = append(send.Components, row)
+			row = discordgo.ActionsRow{}
+		}
+	}
+	if len(row.Components) > 0 {
+		send.Components = append(send.Components, row)
+	}
+
+	_, err := da.Session.ChannelMessageSendComplex(chatID, send)
+	return err
+}
+
+func (da *DiscordAdapter) SendMedia(chatID string, replyToID string, media core.Attachment) error {
 	_, err := da.Session.ChannelMessageSendComplex(chatID, &discordgo.MessageSend{
-		Content:   text,
-		Reference: ref,
+		Content:   truncate(media.Caption, discordMessageLimit),
+		Reference: replyReference(chatID, replyToID),
+		Files: []*discordgo.File{{
+			Name:        media.Name,
+			ContentType: media.MimeType,
+			Reader:      bytes.NewReader(media.Data),
+		}},
 	})
 	return err
 }
 
+// handleInteraction runs the command behind a pressed command button as if
+// the user had typed it.
+func (da *DiscordAdapter) handleInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	command, ok := strings.CutPrefix(i.MessageComponentData().CustomID, commandButtonPrefix)
+	if !ok {
+		return
+	}
+
+	// acknowledge within Discord's 3 second window; the command answers
+	// with a normal message
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		log.Printf("Failed to acknowledge discord interaction: %v", err)
+	}
+
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	if user == nil {
+		return
+	}
+
+	incomingMsg := core.IncomingMessage{
+		Platform:        "discord",
+		UserID:          user.ID,
+		UserName:        user.Username,
+		ChatID:          i.ChannelID,
+		Content:         "!" + da.Core.Config.Name + " " + command,
+		IsDirectMessage: i.GuildID == "",
+	}
+	if i.Message != nil {
+		incomingMsg.MessageID = i.Message.ID
+	}
+	if da.isThread(i.ChannelID) {
+		incomingMsg.ThreadID = i.ChannelID
+	}
+
+	go da.Core.HandleMessage(incomingMsg, da)
+}
+
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max-3]) + "..."
+}
+
+func replyReference(chatID string, messageID string) *discordgo.MessageReference {
+	if messageID == "" {
+		return nil
+	}
+	// don't fail if the original was deleted in the meantime
+	failIfMissing := false
+	return &discordgo.MessageReference{
+		MessageID:       messageID,
+		ChannelID:       chatID,
+		FailIfNotExists: &failIfMissing,
+	}
+}
+
 func (da *DiscordAdapter) SendReaction(chatID string, messageID string, emoji string) error {
 	return da.Session.MessageReactionAdd(chatID, messageID, emoji)
 }
+
+// discordTypingRefresh renews the indicator, which Discord shows for 10 seconds.
+const discordTypingRefresh = 8 * time.Second
+
+func (da *DiscordAdapter) StartTyping(chatID string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(discordTypingRefresh)
+		defer ticker.Stop()
+		for {
+			if err := da.Session.ChannelTyping(chatID); err != nil {
+				log.Printf("Failed to send typing indicator in %s: %v", chatID, err)
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (da *DiscordAdapter) DeleteMessage(chatID string, messageID string) error {
+	return da.Session.ChannelMessageDelete(chatID, messageID)
+}
+
+func (da *DiscordAdapter) OpenDirectChat(userID string) (string, error) {
+	ch, err := da.Session.UserChannelCreate(userID)
+	if err != nil {
+		return "", err
+	}
+	return ch.ID, nil
+}
@@ -0,0 +1,33 @@
+package discord
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestIsMentioned(t *testing.T) {
+	bot := &discordgo.User{ID: "1"}
+	other := &discordgo.User{ID: "2"}
+	tests := []struct {
+		name string
+		msg  discordgo.Message
+		want bool
+	}{
+		{"no mention", discordgo.Message{Content: "hello"}, false},
+		{"ping", discordgo.Message{Mentions: []*discordgo.User{other, bot}}, true},
+		{"ping for someone else", discordgo.Message{Mentions: []*discordgo.User{other}}, false},
+		{"reply to the bot", discordgo.Message{ReferencedMessage: &discordgo.Message{Author: bot}}, true},
+		{"reply to someone else", discordgo.Message{ReferencedMessage: &discordgo.Message{Author: other}}, false},
+		{"reply without author", discordgo.Message{ReferencedMessage: &discordgo.Message{}}, false},
+	}
+
+	da := &DiscordAdapter{BotID: bot.ID}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := da.isMentioned(&tt.msg); got != tt.want {
+				t.Errorf("isMentioned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
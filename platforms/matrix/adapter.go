@@ -3,6 +3,7 @@ package matrix
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -13,27 +14,54 @@ import (
 )
 
 type MatrixAdapter struct {
-	Client   *mautrix.Client
-	Core     *core.Bot
-	Config   *core.BotConfig
-	AutoJoin bool
+	Client       *mautrix.Client
+	Core         *core.Bot
+	Config       *core.BotConfig
+	MatrixConfig *Config
+	AutoJoin     bool
+	// Persona is set for the extra accounts of an appservice, which always
+	// answer with that persona
+	Persona string
+
+	mu          sync.Mutex
+	directCache map[id.RoomID]bool // rooms with exactly two members
+	decryption  map[id.RoomID]*decryptionStats
+	threads     map[id.EventID]id.EventID // event → thread root
+	threadOrder []id.EventID
+
+	verifier *verifier // nil without E2EE
+
+	state   *stateStore // nil unless sync_state_path is set
+	resumed bool        // the first sync continues from a stored token
 }
 
-func NewMatrixAdapter(client *mautrix.Client, coreBot *core.Bot, config *core.BotConfig, autoJoin bool) *MatrixAdapter {
+func NewMatrixAdapter(client *mautrix.Client, coreBot *core.Bot, config *core.BotConfig, matrixConfig *Config) *MatrixAdapter {
 	return &MatrixAdapter{
-		Client:   client,
-		Core:     coreBot,
-		Config:   config,
-		AutoJoin: autoJoin,
+		Client:       client,
+		Core:         coreBot,
+		Config:       config,
+		MatrixConfig: matrixConfig,
+		AutoJoin:     matrixConfig.AutoJoinInvites,
+
+		directCache: make(map[id.RoomID]bool),
+		decryption:  make(map[id.RoomID]*decryptionStats),
+		threads:     make(map[id.EventID]id.EventID),
 	}
 }
 
 func (ma *MatrixAdapter) Start() error {
 	syncer := ma.Client.Syncer.(*mautrix.DefaultSyncer)
+	if err := ma.initCatchUp(context.Background()); err != nil {
+		return err
+	}
 
-	// handle messages
+	// handle messages; encrypted ones are decrypted by the crypto helper
+	// and dispatched here as well
 	syncer.OnEventType(event.EventMessage, ma.handleEvent)
-	// syncer.OnEventType(event.EventEncrypted, ma.handleEvent)
+	ma.watchDecryptionFailures()
+	if err := ma.initVerification(context.Background()); err != nil {
+		return err
+	}
 
 	// handle invites
 	syncer.OnEventType(event.StateMember, ma.handleInvite)
@@ -43,6 +71,8 @@ func (ma *MatrixAdapter) Start() error {
 }
 
 func (ma *MatrixAdapter) handleInvite(ctx context.Context, evt *event.Event) {
+	ma.forgetRoomMembers(evt.RoomID)
+
 	if !ma.AutoJoin {
 		return
 	}
@@ -64,30 +94,48 @@ func (ma *MatrixAdapter) handleInvite(ctx context.Context, evt *event.Event) {
 	}
 }
 
+// matrixMessageLimit keeps the Markdown source of one message well below
+// the 64 KiB event size limit, which also has to fit the rendered HTML.
+const matrixMessageLimit = 16000
+
 func (ma *MatrixAdapter) SendText(chatID string, text string) error {
-	_, err := ma.Client.SendMessageEvent(context.Background(), id.RoomID(chatID), event.EventMessage, &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    text,
-	})
-	return err
+	return ma.send(context.Background(), id.RoomID(chatID), replyTarget{}, text)
 }
 
 func (ma *MatrixAdapter) ReplyText(chatID string, originalMsgID string, text string) error {
-	_, err := ma.Client.SendMessageEvent(context.Background(), id.RoomID(chatID), event.EventMessage, &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    text,
-		RelatesTo: &event.RelatesTo{
-			InReplyTo: &event.InReplyTo{
-				EventID: id.EventID(originalMsgID),
-			},
-		},
-	})
-	return err
+	return ma.send(context.Background(), id.RoomID(chatID), ma.replyTarget(id.EventID(originalMsgID)), text)
+}
+
+// send splits text into as many messages as needed, replying with the
+// first one and keeping all of them in the target's thread. Very long texts
+// are uploaded as a file.
+func (ma *MatrixAdapter) send(ctx context.Context, roomID id.RoomID, target replyTarget, text string) error {
+	chunks := core.SplitMessage(text, matrixMessageLimit)
+	if len(chunks) > ma.Config.MessageChunkLimit() {
+		name, mimeType := core.TextAttachment(text)
+		return ma.sendAttachment(ctx, roomID, target, core.Attachment{
+			Name:     name,
+			MimeType: mimeType,
+			Data:     []byte(text),
+			Caption:  core.LongMessageNotice,
+		})
+	}
+
+	for _, chunk := range chunks {
+		content := renderMarkdown(chunk)
+		target.apply(content)
+		target.replyTo = ""
+		if _, err := ma.Client.SendMessageEvent(ctx, roomID, event.EventMessage, content); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (ma *MatrixAdapter) SendReaction(chatID string, messageID string, emoji string) error {
 	_, err := ma.Client.SendMessageEvent(context.Background(), id.RoomID(chatID), event.EventReaction, &event.ReactionEventContent{
 		RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
 			EventID: id.EventID(messageID),
 			Key:     emoji,
 		},
@@ -95,37 +143,98 @@ func (ma *MatrixAdapter) SendReaction(chatID string, messageID string, emoji str
 	return err
 }
 
-func (ma *MatrixAdapter) downloadImage(ctx context.Context, content *event.MessageEventContent) ([]byte, string, error) {
-	var data []byte
-	var err error
-	var mimeType string
-
-	if content.File != nil {
-		// encrypted image
-		cURI, _ := content.File.URL.Parse()
-		ciphertext, errDownload := ma.Client.DownloadBytes(ctx, cURI)
+const (
+	typingTimeout = 30 * time.Second
+	// refresh well before the homeserver drops the indicator
+	typingRefresh = 20 * time.Second
+)
 
-		if errDownload == nil {
-			err = content.File.DecryptInPlace(ciphertext)
-			if err == nil {
-				data = ciphertext
+func (ma *MatrixAdapter) StartTyping(chatID string) func() {
+	roomID := id.RoomID(chatID)
+	done := make(chan struct{})
+	go func() {
+		ctx := context.Background()
+		ticker := time.NewTicker(typingRefresh)
+		defer ticker.Stop()
+		for {
+			if _, err := ma.Client.UserTyping(ctx, roomID, true, typingTimeout); err != nil {
+				log.Printf("Failed to send typing notification in %s: %v", roomID, err)
+			}
+			select {
+			case <-done:
+				_, _ = ma.Client.UserTyping(ctx, roomID, false, 0)
+				return
+			case <-ticker.C:
 			}
 		}
-	} else if content.URL != "" {
-		// standard image
-		cURI, _ := content.URL.Parse()
-		data, err = ma.Client.DownloadBytes(ctx, cURI)
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (ma *MatrixAdapter) DeleteMessage(chatID string, messageID string) error {
+	_, err := ma.Client.RedactEvent(context.Background(), id.RoomID(chatID), id.EventID(messageID))
+	return err
+}
+
+// maxEventAge keeps the bot from answering old messages replayed by sync,
+// apart from catching up after a restart, see shouldHandle.
+const maxEventAge = 2 * time.Minute
+
+func (ma *MatrixAdapter) handleEvent(ctx context.Context, evt *event.Event) {
+	if handle, catchUp := ma.shouldHandle(evt); handle {
+		ma.processEvent(ctx, evt, catchUp)
 	}
+}
 
-	if info := content.GetInfo(); info != nil {
-		mimeType = info.MimeType
+// addReplyContext fetches the message msg replies to, to quote its text
+// and, if msg has no files of its own, to read the replied-to file.
+func (ma *MatrixAdapter) addReplyContext(ctx context.Context, roomID id.RoomID, msg *core.IncomingMessage) {
+	replyEvt, err := ma.Client.GetEvent(ctx, roomID, id.EventID(msg.ReplyToID))
+	if err != nil {
+		log.Printf("❌ Failed to fetch reply event: %v", err)
+		return
 	}
+	replyEvt.RoomID = roomID
+	_ = replyEvt.Content.ParseRaw(replyEvt.Type)
 
-	return data, mimeType, err
+	if replyEvt.Type == event.EventEncrypted && ma.Client.Crypto != nil {
+		decryptedEvt, err := ma.Client.Crypto.Decrypt(ctx, replyEvt)
+		if err != nil {
+			log.Printf("❌ Failed to decrypt replied event: %v", err)
+			return
+		}
+		replyEvt = decryptedEvt
+	}
+
+	replyContent, ok := replyEvt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return
+	}
+	removeReplyFallback(replyContent)
+
+	quoted := replyContent.Body
+	if isMedia(replyContent) {
+		quoted = mediaCaption(replyContent)
+	}
+	msg.ReplyTo = &core.IncomingMessage{
+		Platform:  "matrix",
+		MessageID: string(replyEvt.ID),
+		UserID:    string(replyEvt.Sender),
+		UserName:  string(replyEvt.Sender),
+		ChatID:    string(roomID),
+		Content:   quoted,
+	}
+
+	if isMedia(replyContent) && len(msg.Attachments) == 0 && len(msg.AttachmentErrors) == 0 {
+		log.Println("🖼️ Found a file in reply history. Downloading...")
+		ma.addAttachment(ctx, msg, replyContent)
+	}
 }
 
-func (ma *MatrixAdapter) handleEvent(ctx context.Context, evt *event.Event) {
-	if evt.Sender == ma.Client.UserID || time.Since(time.UnixMilli(evt.Timestamp)) > 2*time.Minute {
+func (ma *MatrixAdapter) processEvent(ctx context.Context, evt *event.Event, catchUp bool) {
+	if evt.Sender == ma.Client.UserID {
 		return
 	}
 
@@ -134,62 +243,67 @@ func (ma *MatrixAdapter) handleEvent(ctx context.Context, evt *event.Event) {
 		return
 	}
 
-	incomingMsg := core.IncomingMessage{
-		Platform: "matrix",
-		UserID:   string(evt.Sender),
-		UserName: string(evt.Sender),
-		ChatID:   string(evt.RoomID),
-		Content:  msgContent.Body,
-	}
-
-	if msgContent.MsgType == event.MsgImage {
-		data, mime, err := ma.downloadImage(ctx, msgContent)
-		if err == nil && data != nil {
-			incomingMsg.IsImage = true
-			incomingMsg.ImageData = data
-			incomingMsg.ImageMimeType = mime
-		}
+	// the quoted message reaches the bot through ReplyTo instead
+	removeReplyFallback(msgContent)
+	text := msgContent.Body
+	if isMedia(msgContent) {
+		text = mediaCaption(msgContent)
 	}
 
-	if !incomingMsg.IsImage && msgContent.RelatesTo != nil && msgContent.RelatesTo.InReplyTo != nil {
-		replyID := msgContent.RelatesTo.InReplyTo.EventID
-
-		replyEvt, err := ma.Client.GetEvent(ctx, evt.RoomID, replyID)
-		if err != nil {
-			log.Printf("❌ Failed to fetch reply event: %v", err)
-		} else {
-			replyEvt.RoomID = evt.RoomID
-
-			_ = replyEvt.Content.ParseRaw(replyEvt.Type)
-
-			if replyEvt.Type == event.EventEncrypted {
-				if ma.Client.Crypto != nil {
-					decryptedEvt, err := ma.Client.Crypto.Decrypt(ctx, replyEvt)
-					if err == nil {
-						replyEvt = decryptedEvt
-					} else {
-						log.Printf("❌ Failed to decrypt replied event: %v", err)
-					}
-				}
-			}
+	mentioned, pillText := ma.findMention(msgContent)
+	incomingMsg := core.IncomingMessage{
+		Platform:        "matrix",
+		MessageID:       string(evt.ID),
+		UserID:          string(evt.Sender),
+		UserName:        string(evt.Sender),
+		ChatID:          string(evt.RoomID),
+		Content:         stripMention(text, pillText),
+		IsDirectMessage: ma.isDirectChat(ctx, evt.RoomID),
+		IsMention:       mentioned,
+		Persona:         ma.Persona,
+	}
+	// a persona account only speaks when spoken to, leaving the rest of
+	// the room to the main account
+	if ma.Persona != "" && !incomingMsg.IsMention && !incomingMsg.IsDirectMessage {
+		return
+	}
+	// inside threads, the reply relation is usually just a fallback for
+	// clients without thread support
+	if replyTo := msgContent.RelatesTo.GetNonFallbackReplyTo(); replyTo != "" {
+		incomingMsg.ReplyToID = string(replyTo)
+	}
+	if threadRoot := msgContent.RelatesTo.GetThreadParent(); threadRoot != "" {
+		incomingMsg.ThreadID = string(threadRoot)
+		ma.rememberThread(evt.ID, threadRoot)
+	}
 
-			_ = replyEvt.Content.ParseRaw(replyEvt.Type)
-
-			if replyContent, ok := replyEvt.Content.Parsed.(*event.MessageEventContent); ok {
-				if replyContent.MsgType == event.MsgImage {
-					log.Println("🖼️ Found image in reply history. Downloading...")
-					data, mime, err := ma.downloadImage(ctx, replyContent)
-					if err == nil && data != nil {
-						incomingMsg.IsImage = true
-						incomingMsg.ImageData = data
-						incomingMsg.ImageMimeType = mime
-					} else {
-						log.Printf("❌ Failed to download/decrypt image data: %v", err)
-					}
-				}
-			}
+	// files are only downloaded when the bot is asked about them
+	addressed := ma.Core.IsAddressed(&incomingMsg)
+	if catchUp {
+		// only catch up on messages that asked the bot directly, not on
+		// ones that merely contain its name
+		if !incomingMsg.IsMention && !incomingMsg.IsDirectMessage && !ma.Core.IsCommand(&incomingMsg) {
+			return
 		}
+		log.Printf("⏪ Answering %s in %s, sent while the bot was offline", evt.ID, evt.RoomID)
+	}
+	if addressed && isMedia(msgContent) {
+		ma.addAttachment(ctx, &incomingMsg, msgContent)
 	}
 
-	go ma.Core.HandleMessage(incomingMsg, ma)
+	if addressed && incomingMsg.ReplyToID != "" {
+		ma.addReplyContext(ctx, evt.RoomID, &incomingMsg)
+	}
+
+	go func() {
+		ma.Core.HandleMessage(incomingMsg, ma)
+		if !addressed {
+			return
+		}
+		ma.markHandled(evt)
+		// only what the bot answers counts as read by it
+		if err := ma.Client.MarkRead(context.Background(), evt.RoomID, evt.ID); err != nil {
+			log.Printf("Failed to send read receipt in %s: %v", evt.RoomID, err)
+		}
+	}()
 }
@@ -0,0 +1,232 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"rakka/core"
+)
+
+// AppserviceConfig enables running as an application service instead of
+// a logged-in user. The homeserver then pushes events to the bot, which
+// needs no password, isn't rate limited and can act as several users.
+// End-to-end encryption is not available in this mode.
+type AppserviceConfig struct {
+	Enabled          bool   `toml:"enabled"`
+	RegistrationPath string `toml:"registration_path"`
+	// where the homeserver sends transactions, e.g. http://localhost:29331
+	URL string `toml:"url"`
+	// address to listen on, e.g. 0.0.0.0:29331
+	Listen string `toml:"listen"`
+	// register one extra user per persona in [bot.personas], named
+	// @<bot>_<persona>, which always answers with that persona
+	PersonaUsers bool `toml:"persona_users"`
+}
+
+// appserviceID identifies the registration on the homeserver.
+const appserviceID = "rakka"
+
+// GenerateRegistration writes a registration file for the homeserver with
+// fresh tokens. The bot's user_id becomes the appservice's sender, and the
+// users <localpart>_* are reserved for persona accounts.
+func GenerateRegistration(config *Config) error {
+	asConfig := config.Appservice
+	if asConfig.RegistrationPath == "" || asConfig.URL == "" {
+		return errors.New("appservice registration_path and url must be set")
+	}
+	if _, err := os.Stat(asConfig.RegistrationPath); err == nil {
+		return fmt.Errorf("%s already exists; delete it first to create new tokens", asConfig.RegistrationPath)
+	}
+	localpart, server, err := id.UserID(config.UserID).Parse()
+	if err != nil {
+		return fmt.Errorf("invalid user_id: %w", err)
+	}
+
+	rateLimited := false
+	reg := appservice.CreateRegistration()
+	reg.ID = appserviceID
+	reg.URL = asConfig.URL
+	reg.SenderLocalpart = localpart
+	reg.RateLimited = &rateLimited
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(
+		"^@"+regexp.QuoteMeta(localpart)+"_.+:"+regexp.QuoteMeta(server)+"$"), true)
+
+	if err := reg.Save(asConfig.RegistrationPath); err != nil {
+		return fmt.Errorf("failed to write registration: %w", err)
+	}
+	fmt.Printf("✅ Wrote %s. Add it to the homeserver's app_service_config_files and restart the homeserver.\n", asConfig.RegistrationPath)
+	return nil
+}
+
+// Appservice receives transactions from the homeserver and hands messages
+// to one adapter per bot account.
+type Appservice struct {
+	as       *appservice.AppService
+	adapters []*MatrixAdapter
+}
+
+func NewAppservice(coreBot *core.Bot, config *core.BotConfig, matrixConfig *Config) (*Appservice, error) {
+	asConfig := matrixConfig.Appservice
+	reg, err := appservice.LoadRegistration(asConfig.RegistrationPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registration (create it with -generate-registration): %w", err)
+	}
+	localpart, server, err := id.UserID(matrixConfig.UserID).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+	if reg.SenderLocalpart != localpart {
+		return nil, fmt.Errorf("registration is for @%s, but user_id is %s", reg.SenderLocalpart, matrixConfig.UserID)
+	}
+
+	host, portStr, err := net.SplitHostPort(asConfig.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid appservice listen address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid appservice listen port: %w", err)
+	}
+
+	as, err := appservice.CreateFull(appservice.CreateOpts{
+		Registration:     reg,
+		HomeserverDomain: server,
+		HomeserverURL:    matrixConfig.Homeserver,
+		HostConfig:       appservice.HostConfig{Hostname: host, Port: uint16(port)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	asvc := &Appservice{as: as}
+	asvc.adapters = append(asvc.adapters, NewMatrixAdapter(as.BotClient(), coreBot, config, matrixConfig))
+
+	if asConfig.PersonaUsers {
+		names := make([]string, 0, len(config.Personas))
+		for name := range config.Personas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			// localparts are lowercase, persona names may not be
+			personaLocalpart := localpart + "_" + strings.ToLower(name)
+			if err := id.ValidateUserLocalpart(personaLocalpart); err != nil {
+				log.Printf("⚠️ Skipping the account for persona %q: %v (use only a-z, 0-9 and ._=/-)", name, err)
+				continue
+			}
+			userID := id.NewUserID(personaLocalpart, server)
+			adapter := NewMatrixAdapter(as.Client(userID), coreBot, config, matrixConfig)
+			adapter.Persona = name
+			asvc.adapters = append(asvc.adapters, adapter)
+		}
+	}
+	return asvc, nil
+}
+
+// Start registers the bot accounts and serves transactions until the
+// listener fails.
+func (asvc *Appservice) Start() error {
+	ctx := context.Background()
+	config := asvc.adapters[0].Config
+	matrixConfig := asvc.adapters[0].MatrixConfig
+
+	// the homeserver redelivers transactions after downtime, so there is
+	// no sync token, but catching up still needs the handled markers
+	var state *stateStore
+	if matrixConfig.SyncStatePath != "" {
+		var err error
+		if state, err = loadStateStore(matrixConfig.SyncStatePath, asvc.as.BotMXID()); err != nil {
+			return err
+		}
+	}
+
+	for _, adapter := range asvc.adapters {
+		adapter.state = state
+		adapter.resumed = true
+
+		intent := asvc.as.Intent(adapter.Client.UserID)
+		if err := intent.EnsureRegistered(ctx); err != nil {
+			return fmt.Errorf("failed to register %s: %w", adapter.Client.UserID, err)
+		}
+		displayName := config.Name
+		if adapter.Persona != "" {
+			displayName = fmt.Sprintf("%s (%s)", config.Name, adapter.Persona)
+		}
+		if err := intent.SetDisplayName(ctx, displayName); err != nil {
+			log.Printf("⚠️ Failed to set display name of %s: %v", adapter.Client.UserID, err)
+		}
+
+		// the state store starts empty, and messages are only handled in
+		// rooms the account is in
+		rooms, err := adapter.Client.JoinedRooms(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list rooms of %s: %w", adapter.Client.UserID, err)
+		}
+		for _, roomID := range rooms.JoinedRooms {
+			_ = asvc.as.StateStore.SetMembership(ctx, roomID, adapter.Client.UserID, event.MembershipJoin)
+		}
+	}
+
+	processor := appservice.NewEventProcessor(asvc.as)
+	processor.On(event.EventMessage, asvc.handleMessage)
+	processor.On(event.StateMember, asvc.handleMember)
+	processor.Start(ctx)
+	defer processor.Stop()
+
+	log.Printf("Starting Matrix appservice with %d account(s)...", len(asvc.adapters))
+	asvc.as.Start()
+	return errors.New("appservice listener stopped")
+}
+
+// handleMessage passes a message to every bot account in the room. Persona
+// accounts only react when addressed, so one message gets one answer.
+func (asvc *Appservice) handleMessage(ctx context.Context, evt *event.Event) {
+	for _, adapter := range asvc.adapters {
+		if evt.Sender == adapter.Client.UserID {
+			// no bot account answers another
+			return
+		}
+	}
+	// a message mentioning persona accounts is for them only, even if it
+	// also contains the main account's name
+	recipients := asvc.adapters
+	if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok {
+		var mentioned []*MatrixAdapter
+		for _, adapter := range asvc.adapters[1:] {
+			if isMentioned, _ := adapter.findMention(content); isMentioned {
+				mentioned = append(mentioned, adapter)
+			}
+		}
+		if len(mentioned) > 0 {
+			recipients = mentioned
+		}
+	}
+
+	for _, adapter := range recipients {
+		if asvc.as.StateStore.IsInRoom(ctx, evt.RoomID, adapter.Client.UserID) {
+			adapter.handleEvent(ctx, evt)
+		}
+	}
+}
+
+func (asvc *Appservice) handleMember(ctx context.Context, evt *event.Event) {
+	for _, adapter := range asvc.adapters {
+		adapter.forgetRoomMembers(evt.RoomID)
+		if evt.GetStateKey() == adapter.Client.UserID.String() {
+			adapter.handleInvite(ctx, evt)
+		}
+	}
+}
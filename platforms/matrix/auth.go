@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"golang.org/x/crypto/argon2"
@@ -15,6 +17,8 @@ import (
 	"golang.org/x/term"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
+
+	"rakka/core"
 )
 
 type Config struct {
@@ -24,6 +28,41 @@ type Config struct {
 	CryptoDBPath      string `toml:"crypto_db_path"`
 	PickleKey         string `toml:"pickle_key"`
 	AutoJoinInvites   bool   `toml:"auto_join_invites"`
+	// encrypted copy of the cross-signing recovery key, see -bootstrap-cross-signing
+	RecoveryKeyPath string `toml:"recovery_key_path"`
+
+	// how long to keep waiting for room keys of an undecryptable message
+	// after the first key request failed
+	DecryptionRetrySeconds int `toml:"decryption_retry_seconds"`
+	// reply "I couldn't decrypt your message" once retrying gives up
+	NotifyUndecryptable bool `toml:"notify_undecryptable"`
+
+	// largest file the bot downloads, in MB; capped by what the model accepts
+	MaxDownloadMB int `toml:"max_download_mb"`
+
+	// sync token and last answered message per room, for catching up on
+	// mentions and commands sent while the bot was offline
+	SyncStatePath        string `toml:"sync_state_path"`
+	CatchUpMaxAgeMinutes int    `toml:"catch_up_max_age_minutes"`
+
+	// "password" (default) or "sso" for the first login
+	LoginMethod string `toml:"login_method"`
+	// where the browser is sent back to after SSO, default 127.0.0.1:29330
+	SSOCallbackListen string `toml:"sso_callback_listen"`
+	// use this token instead of logging in; MATRIX_ACCESS_TOKEN works too
+	AccessTokenFile string `toml:"access_token_file"`
+	// passphrase for the credentials and recovery key files
+	PassphraseFile string `toml:"passphrase_file"`
+
+	Appservice AppserviceConfig `toml:"appservice"`
+}
+
+// DownloadLimit returns the largest file size the bot downloads in bytes.
+func (c *Config) DownloadLimit() int {
+	if c.MaxDownloadMB > 0 && c.MaxDownloadMB<<20 < core.MaxAttachmentSize {
+		return c.MaxDownloadMB << 20
+	}
+	return core.MaxAttachmentSize
 }
 
 type CredentialStore struct {
@@ -43,6 +82,30 @@ func deriveKey(password string, salt []byte) [32]byte {
 	return key
 }
 
+// sealSecret encrypts plaintext with a key derived from the passphrase and
+// a fresh salt, as used for everything the bot keeps on disk.
+func sealSecret(password string, plaintext []byte) (encrypted []byte, nonce [24]byte, salt []byte, err error) {
+	salt = make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nonce, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, nonce, nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	key := deriveKey(password, salt)
+	return secretbox.Seal(nil, plaintext, &nonce, &key), nonce, salt, nil
+}
+
+func openSecret(password string, encrypted []byte, nonce [24]byte, salt []byte) ([]byte, error) {
+	key := deriveKey(password, salt)
+	decrypted, ok := secretbox.Open(nil, encrypted, &nonce, &key)
+	if !ok {
+		return nil, errors.New("decryption failed")
+	}
+	return decrypted, nil
+}
+
 func getEncryptionKey(password string) [32]byte {
 	key := [32]byte{}
 	copy(key[:], password)
@@ -53,12 +116,63 @@ func getEncryptionKey(password string) [32]byte {
 	return key
 }
 
-func getPassword() (string, error) {
-	if password := os.Getenv("MATRIX_PASSWORD"); password != "" {
-		return password, nil
+// systemd passes credentials set with LoadCredential= as files in this
+// directory.
+const credentialsDirectoryEnv = "CREDENTIALS_DIRECTORY"
+
+// readSecret returns the first secret found in the config file path, the
+// systemd credential of the given name or the environment variables.
+func readSecret(path, credential string, envVars ...string) (string, error) {
+	if path == "" {
+		if dir := os.Getenv(credentialsDirectoryEnv); dir != "" {
+			if candidate := filepath.Join(dir, credential); fileExists(candidate) {
+				path = candidate
+			}
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		return strings.TrimSpace(string(data)), nil
 	}
 
-	fmt.Print("🔑 Enter Matrix password (or set MATRIX_PASSWORD env var): ")
+	for _, name := range envVars {
+		if value := os.Getenv(name); value != "" {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// GetPassphrase returns the passphrase that encrypts the credentials and
+// recovery key files. With password login it is the account password. It
+// is read from passphrase_file, the systemd credential matrix_passphrase,
+// MATRIX_PASSPHRASE or MATRIX_PASSWORD, and only asked for on a terminal.
+// When an access token is configured the passphrase is optional.
+func GetPassphrase(config *Config) (string, error) {
+	passphrase, err := readSecret(config.PassphraseFile, "matrix_passphrase", "MATRIX_PASSPHRASE", "MATRIX_PASSWORD")
+	if err != nil || passphrase != "" {
+		return passphrase, err
+	}
+	if hasAccessToken(config) {
+		return "", nil
+	}
+
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return "", errors.New("no Matrix passphrase: set passphrase_file, the systemd credential matrix_passphrase or MATRIX_PASSPHRASE")
+	}
+	if config.LoginMethod == loginSSO {
+		fmt.Print("🔑 Enter a passphrase to encrypt the stored Matrix credentials: ")
+	} else {
+		fmt.Print("🔑 Enter Matrix password (or set MATRIX_PASSWORD env var): ")
+	}
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
 	fmt.Println()
 	if err != nil {
@@ -83,10 +197,9 @@ func loadCredentials(dbPath, password string) (*mautrix.Client, error) {
 		return nil, errors.New("legacy credentials file detected (no salt). Please delete the credentials.json file and log in again to upgrade security")
 	}
 
-	key := deriveKey(password, store.Salt)
-	decrypted, ok := secretbox.Open(nil, store.EncryptedData, &store.Nonce, &key)
-	if !ok {
-		return nil, errors.New("failed to decrypt credentials - wrong password?")
+	decrypted, err := openSecret(password, store.EncryptedData, store.Nonce, store.Salt)
+	if err != nil {
+		return nil, errors.New("failed to decrypt credentials - wrong passphrase?")
 	}
 
 	client, err := mautrix.NewClient(store.Homeserver, id.UserID(store.UserID), string(decrypted))
@@ -98,45 +211,17 @@ func loadCredentials(dbPath, password string) (*mautrix.Client, error) {
 	return client, nil
 }
 
-func loginAndSaveCredentials(homeserver, userID, password, dbPath string) (*mautrix.Client, error) {
-	fmt.Printf("Logging into %s as %s...\n", homeserver, userID)
-
-	client, err := mautrix.NewClient(homeserver, id.UserID(userID), "")
+// saveCredentials stores the access token of a fresh login, encrypted with
+// the passphrase.
+func saveCredentials(dbPath, homeserver, passphrase string, resp *mautrix.RespLogin) error {
+	encrypted, nonce, salt, err := sealSecret(passphrase, []byte(resp.AccessToken))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %w", err)
+		return err
 	}
 
-	resp, err := client.Login(context.Background(), &mautrix.ReqLogin{
-		Type: "m.login.password",
-		Identifier: mautrix.UserIdentifier{
-			Type: "m.id.user",
-			User: userID,
-		},
-		Password: password,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("login failed: %w", err)
-	}
-
-	client.AccessToken = resp.AccessToken
-	client.DeviceID = resp.DeviceID
-
-	salt := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return nil, fmt.Errorf("failed to generate salt: %w", err)
-	}
-
-	key := deriveKey(password, salt)
-	var nonce [24]byte
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
-
-	encrypted := secretbox.Seal(nil, []byte(resp.AccessToken), &nonce, &key)
-
 	store := CredentialStore{
 		Homeserver:    homeserver,
-		UserID:        userID,
+		UserID:        string(resp.UserID),
 		DeviceID:      string(resp.DeviceID),
 		EncryptedData: encrypted,
 		Nonce:         nonce,
@@ -145,33 +230,76 @@ func loginAndSaveCredentials(homeserver, userID, password, dbPath string) (*maut
 
 	data, err := json.Marshal(store)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal credentials: %w", err)
+		return fmt.Errorf("failed to marshal credentials: %w", err)
 	}
 
 	if err := os.WriteFile(dbPath, data, 0600); err != nil {
-		return nil, fmt.Errorf("failed to write credentials file: %w", err)
+		return fmt.Errorf("failed to write credentials file: %w", err)
 	}
 
 	fmt.Println("Credentials saved to:", dbPath)
+	return nil
+}
+
+func loginAndSaveCredentials(config *Config, passphrase string) (*mautrix.Client, error) {
+	if passphrase == "" {
+		return nil, errors.New("a passphrase is needed to store the credentials")
+	}
+	fmt.Printf("Logging into %s as %s...\n", config.Homeserver, config.UserID)
+
+	client, err := mautrix.NewClient(config.Homeserver, id.UserID(config.UserID), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	var resp *mautrix.RespLogin
+	switch config.LoginMethod {
+	case loginSSO:
+		resp, err = loginWithSSO(context.Background(), client, config)
+	case "", loginPassword:
+		resp, err = client.Login(context.Background(), &mautrix.ReqLogin{
+			Type: mautrix.AuthTypePassword,
+			Identifier: mautrix.UserIdentifier{
+				Type: mautrix.IdentifierTypeUser,
+				User: config.UserID,
+			},
+			Password: passphrase,
+		})
+	default:
+		return nil, fmt.Errorf("unknown login_method %q", config.LoginMethod)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("login failed: %w", err)
+	}
+	if resp.UserID != client.UserID {
+		return nil, fmt.Errorf("logged in as %s instead of %s", resp.UserID, client.UserID)
+	}
+
+	client.AccessToken = resp.AccessToken
+	client.DeviceID = resp.DeviceID
+
+	if err := saveCredentials(config.CredentialsDBPath, config.Homeserver, passphrase, resp); err != nil {
+		return nil, err
+	}
 	return client, nil
 }
 
-func GetMatrixClient(config *Config) (*mautrix.Client, error) {
-	password, err := getPassword()
+// GetMatrixClient uses a configured access token, the stored credentials,
+// or logs in and stores them.
+func GetMatrixClient(config *Config, passphrase string) (*mautrix.Client, error) {
+	token, err := getAccessToken(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get password: %w", err)
+		return nil, err
+	}
+	if token != "" {
+		return clientFromAccessToken(config, token)
 	}
 
 	if _, err := os.Stat(config.CredentialsDBPath); os.IsNotExist(err) {
 		fmt.Println("First-time login detected...")
-		return loginAndSaveCredentials(
-			config.Homeserver,
-			config.UserID,
-			password,
-			config.CredentialsDBPath,
-		)
+		return loginAndSaveCredentials(config, passphrase)
 	}
 
 	fmt.Println("Loading existing session...")
-	return loadCredentials(config.CredentialsDBPath, password)
+	return loadCredentials(config.CredentialsDBPath, passphrase)
 }
@@ -0,0 +1,174 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// handledMarker is the newest message of a room the bot has handled.
+type handledMarker struct {
+	EventID   id.EventID `json:"event_id"`
+	Timestamp int64      `json:"timestamp"`
+}
+
+type syncState struct {
+	UserID      id.UserID                    `json:"user_id"`
+	FilterID    string                       `json:"filter_id,omitempty"`
+	NextBatch   string                       `json:"next_batch,omitempty"`
+	LastHandled map[id.RoomID]*handledMarker `json:"last_handled"`
+}
+
+// stateStore keeps the sync token and the per-room markers on disk, so
+// that after a restart the bot can answer what it missed without answering
+// anything twice. It also serves as the client's sync store when E2EE is
+// disabled; otherwise the crypto database keeps the token.
+type stateStore struct {
+	mu    sync.Mutex
+	path  string
+	state syncState
+}
+
+var _ mautrix.SyncStore = (*stateStore)(nil)
+
+func loadStateStore(path string, userID id.UserID) (*stateStore, error) {
+	store := &stateStore{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read sync state: %w", err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &store.state); err != nil {
+			return nil, fmt.Errorf("failed to parse sync state: %w", err)
+		}
+	}
+
+	// a token or filter of another account is useless
+	if store.state.UserID != userID {
+		store.state = syncState{UserID: userID}
+	}
+	if store.state.LastHandled == nil {
+		store.state.LastHandled = make(map[id.RoomID]*handledMarker)
+	}
+	return store, nil
+}
+
+// saveLocked writes the state through a temporary file so that a crash
+// can't leave a truncated file behind.
+func (s *stateStore) saveLocked() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *stateStore) SaveFilterID(ctx context.Context, userID id.UserID, filterID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.FilterID = filterID
+	return s.saveLocked()
+}
+
+func (s *stateStore) LoadFilterID(ctx context.Context, userID id.UserID) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.FilterID, nil
+}
+
+func (s *stateStore) SaveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.NextBatch = nextBatchToken
+	return s.saveLocked()
+}
+
+func (s *stateStore) LoadNextBatch(ctx context.Context, userID id.UserID) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.NextBatch, nil
+}
+
+// handled reports whether evt is at or before the room's marker.
+func (s *stateStore) handled(evt *event.Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	marker := s.state.LastHandled[evt.RoomID]
+	return marker != nil && (evt.Timestamp < marker.Timestamp || evt.ID == marker.EventID)
+}
+
+// markHandled moves the room's marker forward to evt.
+func (s *stateStore) markHandled(evt *event.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	marker := s.state.LastHandled[evt.RoomID]
+	if marker != nil && evt.Timestamp < marker.Timestamp {
+		return
+	}
+	s.state.LastHandled[evt.RoomID] = &handledMarker{EventID: evt.ID, Timestamp: evt.Timestamp}
+	if err := s.saveLocked(); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+}
+
+// initCatchUp loads the sync state. Catching up only happens when the bot
+// resumes from a stored sync token; a fresh login would otherwise answer
+// old history.
+func (ma *MatrixAdapter) initCatchUp(ctx context.Context) error {
+	if ma.MatrixConfig.SyncStatePath == "" {
+		return nil
+	}
+	store, err := loadStateStore(ma.MatrixConfig.SyncStatePath, ma.Client.UserID)
+	if err != nil {
+		return err
+	}
+	ma.state = store
+
+	if _, isMemory := ma.Client.Store.(*mautrix.MemorySyncStore); isMemory {
+		ma.Client.Store = store
+	}
+	token, err := ma.Client.Store.LoadNextBatch(ctx, ma.Client.UserID)
+	ma.resumed = err == nil && token != ""
+	return nil
+}
+
+func (ma *MatrixAdapter) catchUpMaxAge() time.Duration {
+	return time.Duration(ma.MatrixConfig.CatchUpMaxAgeMinutes) * time.Minute
+}
+
+// shouldHandle decides whether evt is processed at all, and whether it is
+// an older message found while catching up after a restart.
+func (ma *MatrixAdapter) shouldHandle(evt *event.Event) (handle bool, catchUp bool) {
+	if ma.state != nil && ma.state.handled(evt) {
+		return false, false
+	}
+	age := time.Since(time.UnixMilli(evt.Timestamp))
+	if age <= maxEventAge {
+		return true, false
+	}
+	if ma.state != nil && ma.resumed && age <= ma.catchUpMaxAge() {
+		return true, true
+	}
+	return false, false
+}
+
+// markHandled records that evt was handled, if the state is persisted.
+func (ma *MatrixAdapter) markHandled(evt *event.Event) {
+	if ma.state != nil {
+		ma.state.markHandled(evt)
+	}
+}
@@ -0,0 +1,197 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/cryptohelper"
+	"maunium.net/go/mautrix/id"
+)
+
+// RecoveryKeyStore holds the cross-signing recovery key, encrypted with the
+// passphrase like the credentials file.
+type RecoveryKeyStore struct {
+	UserID        string   `json:"user_id"`
+	EncryptedData []byte   `json:"encrypted_data"`
+	Nonce         [24]byte `json:"nonce"`
+	Salt          []byte   `json:"salt"`
+}
+
+func saveRecoveryKey(path, userID, password, recoveryKey string) error {
+	encrypted, nonce, salt, err := sealSecret(password, []byte(recoveryKey))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(RecoveryKeyStore{
+		UserID:        userID,
+		EncryptedData: encrypted,
+		Nonce:         nonce,
+		Salt:          salt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal recovery key: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write recovery key file: %w", err)
+	}
+	return nil
+}
+
+// loadRecoveryKey returns an empty key if none has been stored yet.
+func loadRecoveryKey(path, password string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read recovery key file: %w", err)
+	}
+
+	var store RecoveryKeyStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return "", fmt.Errorf("failed to parse recovery key file: %w", err)
+	}
+
+	decrypted, err := openSecret(password, store.EncryptedData, store.Nonce, store.Salt)
+	if err != nil {
+		return "", errors.New("failed to decrypt recovery key - wrong password?")
+	}
+	return string(decrypted), nil
+}
+
+func readRecoveryKey() (string, error) {
+	if key := os.Getenv("MATRIX_RECOVERY_KEY"); key != "" {
+		return key, nil
+	}
+
+	fmt.Print("🔑 This account already has cross-signing keys. Enter its recovery key (or set MATRIX_RECOVERY_KEY): ")
+	key, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+func cryptoMachine(client *mautrix.Client) (*crypto.OlmMachine, error) {
+	helper, ok := client.Crypto.(*cryptohelper.CryptoHelper)
+	if !ok {
+		return nil, errors.New("end-to-end encryption is disabled, set crypto_db_path")
+	}
+	return helper.Machine(), nil
+}
+
+// BootstrapCrossSigning signs the bot's device with the account's
+// cross-signing keys, creating them first if the account has none. The
+// recovery key is stored encrypted at RecoveryKeyPath so that later
+// devices can be signed automatically on startup.
+func BootstrapCrossSigning(ctx context.Context, client *mautrix.Client, config *Config, password string) error {
+	if config.RecoveryKeyPath == "" {
+		return errors.New("recovery_key_path is not set")
+	}
+	if password == "" {
+		return errors.New("a passphrase is needed to store the recovery key")
+	}
+	mach, err := cryptoMachine(client)
+	if err != nil {
+		return err
+	}
+
+	if _, err := mach.FetchKeys(ctx, []id.UserID{client.UserID}, true); err != nil {
+		return fmt.Errorf("failed to fetch own keys: %w", err)
+	}
+	hasKeys, _, err := mach.GetOwnVerificationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	if hasKeys {
+		recoveryKey, err := loadRecoveryKey(config.RecoveryKeyPath, password)
+		if err != nil {
+			return err
+		}
+		if recoveryKey == "" {
+			if recoveryKey, err = readRecoveryKey(); err != nil {
+				return fmt.Errorf("failed to read recovery key: %w", err)
+			}
+		}
+
+		if err := mach.VerifyWithRecoveryKey(ctx, recoveryKey); err != nil {
+			return fmt.Errorf("failed to sign device with recovery key: %w", err)
+		}
+		if err := saveRecoveryKey(config.RecoveryKeyPath, client.UserID.String(), password, recoveryKey); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Device %s is now signed with the existing cross-signing keys.\n", client.DeviceID)
+		return nil
+	}
+
+	// uploading new keys needs the account password; after an SSO or token
+	// login, set up cross-signing in another client and use its recovery key
+	recoveryKey, _, err := mach.GenerateAndUploadCrossSigningKeysWithPassword(ctx, password, "")
+	if err != nil {
+		return err
+	}
+	// save first so that the key isn't lost if signing fails
+	if err := saveRecoveryKey(config.RecoveryKeyPath, client.UserID.String(), password, recoveryKey); err != nil {
+		return err
+	}
+	if err := mach.SignOwnDevice(ctx, mach.OwnIdentity()); err != nil {
+		return fmt.Errorf("failed to sign own device: %w", err)
+	}
+	if err := mach.SignOwnMasterKey(ctx); err != nil {
+		return fmt.Errorf("failed to sign own master key: %w", err)
+	}
+
+	fmt.Printf("✅ Cross-signing is set up and device %s is signed.\n", client.DeviceID)
+	fmt.Printf("Recovery key (also saved encrypted to %s), keep a copy somewhere safe:\n\n    %s\n\n", config.RecoveryKeyPath, recoveryKey)
+	return nil
+}
+
+// EnsureCrossSigned signs a new device with the stored recovery key. It
+// only logs problems since the bot works without cross-signing.
+func EnsureCrossSigned(ctx context.Context, client *mautrix.Client, config *Config, password string) {
+	mach, err := cryptoMachine(client)
+	if err != nil || config.RecoveryKeyPath == "" || password == "" {
+		return
+	}
+
+	hasKeys, verified, err := mach.GetOwnVerificationStatus(ctx)
+	if err != nil {
+		log.Printf("⚠️ Failed to check cross-signing status: %v", err)
+		return
+	}
+	if verified {
+		return
+	}
+	if !hasKeys {
+		log.Println("⚠️ Cross-signing is not set up. Run with -bootstrap-cross-signing so clients trust this device.")
+		return
+	}
+
+	recoveryKey, err := loadRecoveryKey(config.RecoveryKeyPath, password)
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+		return
+	}
+	if recoveryKey == "" {
+		log.Println("⚠️ This device is not cross-signed. Run with -bootstrap-cross-signing to sign it.")
+		return
+	}
+
+	if err := mach.VerifyWithRecoveryKey(ctx, recoveryKey); err != nil {
+		log.Printf("⚠️ Failed to cross-sign device %s: %v", client.DeviceID, err)
+		return
+	}
+	log.Printf("🔏 Signed device %s with the stored cross-signing keys", client.DeviceID)
+}
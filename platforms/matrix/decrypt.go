@@ -0,0 +1,120 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/cryptohelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultDecryptionRetry = 2 * time.Minute
+	// at most one "couldn't decrypt" notice per room in this interval, so
+	// a broken session doesn't make the bot answer every message
+	undecryptableNoticeCooldown = 10 * time.Minute
+)
+
+type decryptionStats struct {
+	Failed     int
+	Recovered  int
+	lastNotice time.Time
+}
+
+// watchDecryptionFailures hooks into the crypto helper, which has already
+// waited for keys and sent one key request when it reports a failure.
+func (ma *MatrixAdapter) watchDecryptionFailures() {
+	helper, ok := ma.Client.Crypto.(*cryptohelper.CryptoHelper)
+	if !ok {
+		return
+	}
+	helper.DecryptErrorCallback = func(evt *event.Event, err error) {
+		go ma.handleUndecryptable(helper, evt, err)
+	}
+}
+
+func (ma *MatrixAdapter) decryptionRetryTimeout() time.Duration {
+	if ma.MatrixConfig.DecryptionRetrySeconds > 0 {
+		return time.Duration(ma.MatrixConfig.DecryptionRetrySeconds) * time.Second
+	}
+	return defaultDecryptionRetry
+}
+
+// handleUndecryptable asks for the missing keys again and handles the
+// message if they arrive in time. Otherwise it gives up and optionally
+// tells the sender.
+func (ma *MatrixAdapter) handleUndecryptable(helper *cryptohelper.CryptoHelper, evt *event.Event, err error) {
+	if evt.Sender == ma.Client.UserID {
+		return
+	}
+	ctx := context.Background()
+	// only new messages, or ones missed while offline, get an answer
+	handle, catchUp := ma.shouldHandle(evt)
+
+	if errors.Is(err, crypto.NoSessionFound) {
+		content := evt.Content.AsEncrypted()
+		log.Printf("🔒 Missing room keys for %s in %s, requesting them again", evt.ID, evt.RoomID)
+
+		// after our device changed, the sender's other devices or our own
+		// devices may still be able to share the session
+		helper.RequestSession(ctx, evt.RoomID, content.SenderKey, content.SessionID, evt.Sender, "*")
+		if helper.WaitForSession(ctx, evt.RoomID, content.SenderKey, content.SessionID, ma.decryptionRetryTimeout()) {
+			decrypted, decErr := helper.Decrypt(ctx, evt)
+			if decErr == nil {
+				stats := ma.recordDecryption(evt.RoomID, nil)
+				log.Printf("🔓 Decrypted %s in %s after retrying (room totals: %d failed, %d recovered)", evt.ID, evt.RoomID, stats.Failed, stats.Recovered)
+				if handle {
+					ma.processEvent(ctx, decrypted, catchUp)
+				}
+				return
+			}
+			err = decErr
+		}
+	}
+
+	stats := ma.recordDecryption(evt.RoomID, err)
+	log.Printf("❌ Failed to decrypt %s from %s in %s: %v (room totals: %d failed, %d recovered)", evt.ID, evt.Sender, evt.RoomID, err, stats.Failed, stats.Recovered)
+
+	if handle && !catchUp && ma.MatrixConfig.NotifyUndecryptable && ma.claimDecryptionNotice(evt.RoomID) {
+		notice := "🔒 I couldn't decrypt your message, so I can't answer it. My device may have changed since you last wrote; please send it again."
+		if err := ma.ReplyText(evt.RoomID.String(), evt.ID.String(), notice); err != nil {
+			log.Printf("Failed to send decryption notice in %s: %v", evt.RoomID, err)
+		}
+	}
+}
+
+// recordDecryption counts a failure, or a recovery if err is nil, and
+// returns the updated totals for the room.
+func (ma *MatrixAdapter) recordDecryption(roomID id.RoomID, err error) decryptionStats {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	stats, ok := ma.decryption[roomID]
+	if !ok {
+		stats = &decryptionStats{}
+		ma.decryption[roomID] = stats
+	}
+	if err != nil {
+		stats.Failed++
+	} else {
+		stats.Recovered++
+	}
+	return *stats
+}
+
+// claimDecryptionNotice reports whether a notice may be sent in the room now.
+func (ma *MatrixAdapter) claimDecryptionNotice(roomID id.RoomID) bool {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	stats := ma.decryption[roomID]
+	if stats == nil || time.Since(stats.lastNotice) < undecryptableNoticeCooldown {
+		return false
+	}
+	stats.lastNotice = time.Now()
+	return true
+}
@@ -0,0 +1,85 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// isDirectChat reports whether the room only has the bot and one other
+// member. Being listed in m.direct isn't enough: such a room may have
+// gained members since, and secrets like API keys are only accepted in
+// direct chats. Member counts are cached until the next membership change
+// in the room.
+func (ma *MatrixAdapter) isDirectChat(ctx context.Context, roomID id.RoomID) bool {
+	ma.mu.Lock()
+	isDirect, cached := ma.directCache[roomID]
+	ma.mu.Unlock()
+	if cached {
+		return isDirect
+	}
+
+	members, err := ma.Client.JoinedMembers(ctx, roomID)
+	if err != nil {
+		return false
+	}
+	isDirect = len(members.Joined) == 2
+
+	ma.mu.Lock()
+	ma.directCache[roomID] = isDirect
+	ma.mu.Unlock()
+	return isDirect
+}
+
+func (ma *MatrixAdapter) forgetRoomMembers(roomID id.RoomID) {
+	ma.mu.Lock()
+	delete(ma.directCache, roomID)
+	ma.mu.Unlock()
+}
+
+func (ma *MatrixAdapter) OpenDirectChat(userID string) (string, error) {
+	ctx := context.Background()
+	target := id.UserID(userID)
+
+	directRooms := event.DirectChatsEventContent{}
+	_ = ma.Client.GetAccountData(ctx, event.AccountDataDirectChats.Type, &directRooms)
+
+	for _, roomID := range directRooms[target] {
+		members, err := ma.Client.JoinedMembers(ctx, roomID)
+		if err != nil {
+			continue
+		}
+		if _, ok := members.Joined[target]; ok {
+			return roomID.String(), nil
+		}
+	}
+
+	req := &mautrix.ReqCreateRoom{
+		Preset:   "trusted_private_chat",
+		Invite:   []id.UserID{target},
+		IsDirect: true,
+	}
+	if ma.Client.Crypto != nil {
+		req.InitialState = []*event.Event{{
+			Type: event.StateEncryption,
+			Content: event.Content{Parsed: &event.EncryptionEventContent{
+				Algorithm: id.AlgorithmMegolmV1,
+			}},
+		}}
+	}
+
+	resp, err := ma.Client.CreateRoom(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create direct chat: %w", err)
+	}
+
+	directRooms[target] = append(directRooms[target], resp.RoomID)
+	if err := ma.Client.SetAccountData(ctx, event.AccountDataDirectChats.Type, directRooms); err != nil {
+		return "", fmt.Errorf("failed to update m.direct: %w", err)
+	}
+
+	return resp.RoomID.String(), nil
+}
@@ -0,0 +1,154 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	loginPassword = "password"
+	loginSSO      = "sso"
+
+	defaultSSOCallbackListen = "127.0.0.1:29330"
+	ssoTimeout               = 5 * time.Minute
+)
+
+// getAccessToken returns a token from access_token_file, the systemd
+// credential matrix_access_token or MATRIX_ACCESS_TOKEN, if any is set.
+func getAccessToken(config *Config) (string, error) {
+	return readSecret(config.AccessTokenFile, "matrix_access_token", "MATRIX_ACCESS_TOKEN")
+}
+
+func hasAccessToken(config *Config) bool {
+	token, err := getAccessToken(config)
+	return err == nil && token != ""
+}
+
+// clientFromAccessToken asks the homeserver which device the token belongs
+// to, which E2EE needs, and makes sure it is the configured account.
+func clientFromAccessToken(config *Config, token string) (*mautrix.Client, error) {
+	client, err := mautrix.NewClient(config.Homeserver, id.UserID(config.UserID), token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	whoami, err := client.Whoami(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("access token rejected: %w", err)
+	}
+	if whoami.UserID != client.UserID {
+		return nil, fmt.Errorf("access token belongs to %s, not %s", whoami.UserID, client.UserID)
+	}
+	client.DeviceID = whoami.DeviceID
+
+	fmt.Println("Using the configured access token...")
+	return client, nil
+}
+
+// loginWithSSO sends the user to the homeserver's SSO page, which redirects
+// the browser back to a local listener with a login token. The token is
+// then exchanged for an access token with m.login.token.
+func loginWithSSO(ctx context.Context, client *mautrix.Client, config *Config) (*mautrix.RespLogin, error) {
+	flows, err := client.GetLoginFlows(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login flows: %w", err)
+	}
+	if !flows.HasFlow(mautrix.AuthTypeSSO) || !flows.HasFlow(mautrix.AuthTypeToken) {
+		return nil, errors.New("the homeserver doesn't support SSO login")
+	}
+
+	listen := config.SSOCallbackListen
+	if listen == "" {
+		listen = defaultSSOCallbackListen
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the SSO callback: %w", err)
+	}
+
+	tokens := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("loginToken")
+		if token == "" {
+			http.Error(w, "missing loginToken", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Logged in. You can close this page.")
+		select {
+		case tokens <- token:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	redirectURL := "http://" + listener.Addr().String() + "/"
+	ssoURL := client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "login", "sso", "redirect"}, map[string]string{
+		"redirectUrl": redirectURL,
+	})
+	fmt.Printf("🌐 Open this link in a browser and log in as %s:\n\n    %s\n\n", config.UserID, ssoURL)
+	fmt.Printf("The browser is sent back to %s; forward that port if the bot runs elsewhere.\n", redirectURL)
+
+	var loginToken string
+	select {
+	case loginToken = <-tokens:
+	case <-time.After(ssoTimeout):
+		return nil, errors.New("timed out waiting for SSO login")
+	}
+
+	return client.Login(ctx, &mautrix.ReqLogin{
+		Type:  mautrix.AuthTypeToken,
+		Token: loginToken,
+	})
+}
+
+// Logout invalidates the bot's access token and removes the stored
+// credentials and the crypto database of the now deleted device, so that
+// the next start logs in as a new device. The recovery key and sync state
+// are kept.
+func Logout(config *Config, passphrase string) error {
+	token, err := getAccessToken(config)
+	if err != nil {
+		return err
+	}
+	if token == "" && !fileExists(config.CredentialsDBPath) {
+		fmt.Println("Not logged in.")
+		return nil
+	}
+
+	client, err := GetMatrixClient(config, passphrase)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Logout(context.Background()); err != nil {
+		// an already invalid token still leaves the files to clean up
+		if !errors.Is(err, mautrix.MUnknownToken) {
+			return fmt.Errorf("logout failed: %w", err)
+		}
+		log.Printf("⚠️ Access token was already invalid")
+	}
+	fmt.Printf("Logged out device %s.\n", client.DeviceID)
+
+	paths := []string{config.CredentialsDBPath}
+	if config.CryptoDBPath != "" {
+		paths = append(paths, config.CryptoDBPath, config.CryptoDBPath+"-wal", config.CryptoDBPath+"-shm")
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	if token != "" {
+		fmt.Println("The configured access token no longer works; replace it before starting again.")
+	}
+	return nil
+}
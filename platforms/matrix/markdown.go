@@ -0,0 +1,72 @@
+package matrix
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer/html"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/format/mdext"
+)
+
+// markdownRenderer escapes any raw HTML in the input instead of passing it
+// through, and drops unsafe link targets such as javascript: URLs. LLM
+// output is untrusted, so this must never use html.WithUnsafe.
+var markdownRenderer = goldmark.New(
+	format.Extensions,
+	goldmark.WithRendererOptions(html.WithHardWraps()),
+	goldmark.WithExtensions(mdext.EscapeHTML),
+)
+
+func keepText(text string, _ format.Context) string { return text }
+
+// plainTextParser turns our rendered HTML back into text without Markdown
+// markers, for Body. Spoilers are hidden since Body shows up in notifications.
+var plainTextParser = &format.HTMLParser{
+	TabsToSpaces:           4,
+	Newline:                "\n",
+	HorizontalLine:         "\n---\n",
+	PillConverter:          format.DefaultPillConverter,
+	BoldConverter:          keepText,
+	ItalicConverter:        keepText,
+	StrikethroughConverter: keepText,
+	UnderlineConverter:     keepText,
+	MonospaceConverter:     keepText,
+	MonospaceBlockConverter: func(code, _ string, _ format.Context) string {
+		return strings.TrimRight(code, "\n")
+	},
+	SpoilerConverter: func(_, reason string, _ format.Context) string {
+		if reason != "" {
+			return "[Spoiler: " + reason + "]"
+		}
+		return "[Spoiler]"
+	},
+}
+
+var (
+	tableCellBoundary = regexp.MustCompile(`</t[hd]>\s*<t[hd][^>]*>`)
+	tableRowStart     = regexp.MustCompile(`<tr[^>]*>`)
+	tableRowEnd       = regexp.MustCompile(`</tr>`)
+	tableTags         = regexp.MustCompile(`</?(table|thead|tbody|th|td)[^>]*>`)
+)
+
+// renderMarkdown builds a text message with sanitized HTML in FormattedBody
+// and a clean plain-text fallback in Body.
+func renderMarkdown(text string) *event.MessageEventContent {
+	content := format.RenderMarkdownCustom(text, markdownRenderer)
+	if content.Format != event.FormatHTML {
+		return &content
+	}
+
+	// the HTML parser has no notion of tables, so flatten them into one
+	// paragraph per row before converting
+	plain := tableCellBoundary.ReplaceAllString(content.FormattedBody, " | ")
+	plain = tableRowStart.ReplaceAllString(plain, "<p>")
+	plain = tableRowEnd.ReplaceAllString(plain, "</p>")
+	plain = tableTags.ReplaceAllString(plain, "")
+	content.Body = strings.TrimSpace(plainTextParser.Parse(plain, format.NewContext(context.TODO())))
+	return &content
+}
@@ -0,0 +1,295 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"rakka/core"
+)
+
+// isEncrypted reports whether events sent to the room get encrypted.
+func (ma *MatrixAdapter) isEncrypted(ctx context.Context, roomID id.RoomID) bool {
+	if ma.Client.Crypto == nil || ma.Client.StateStore == nil {
+		return false
+	}
+	encrypted, err := ma.Client.StateStore.IsEncrypted(ctx, roomID)
+	return err == nil && encrypted
+}
+
+// uploadFile uploads data for content, which must already have its Info
+// and FileName set. In encrypted rooms the file is encrypted before upload
+// and referenced through content.File instead of content.URL.
+func (ma *MatrixAdapter) uploadFile(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent, data []byte) error {
+	content.Info.Size = len(data)
+
+	if !ma.isEncrypted(ctx, roomID) {
+		resp, err := ma.Client.UploadBytesWithName(ctx, data, content.Info.MimeType, content.FileName)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", content.FileName, err)
+		}
+		content.URL = resp.ContentURI.CUString()
+		return nil
+	}
+
+	file := attachment.NewEncryptedFile()
+	resp, err := ma.Client.UploadBytes(ctx, file.Encrypt(data), "application/octet-stream")
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", content.FileName, err)
+	}
+	content.File = &event.EncryptedFileInfo{
+		EncryptedFile: *file,
+		URL:           resp.ContentURI.CUString(),
+	}
+	return nil
+}
+
+// maxRemoteImageSize bounds images fetched from URLs for rich messages.
+const maxRemoteImageSize = 10 * 1024 * 1024
+
+// fetchImage downloads an image referenced by URL so it can be re-uploaded
+// to the homeserver.
+func fetchImage(ctx context.Context, imageURL string) (core.Attachment, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return core.Attachment{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return core.Attachment{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return core.Attachment{}, fmt.Errorf("fetching %s: status %d", imageURL, resp.StatusCode)
+	}
+	mimeType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(mimeType, "image/") {
+		return core.Attachment{}, fmt.Errorf("fetching %s: not an image (%s)", imageURL, mimeType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteImageSize+1))
+	if err != nil {
+		return core.Attachment{}, err
+	}
+	if len(data) > maxRemoteImageSize {
+		return core.Attachment{}, fmt.Errorf("fetching %s: image too large", imageURL)
+	}
+
+	return core.Attachment{
+		Name:     path.Base(req.URL.Path),
+		MimeType: mimeType,
+		Data:     data,
+	}, nil
+}
+
+// mediaMsgType picks the event msgtype clients render best for a MIME type.
+func mediaMsgType(mimeType string) event.MessageType {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// sendAttachment uploads att and sends it as a media event. A caption goes
+// in the body, which otherwise holds the file name.
+func (ma *MatrixAdapter) sendAttachment(ctx context.Context, roomID id.RoomID, target replyTarget, att core.Attachment) error {
+	content := &event.MessageEventContent{
+		MsgType:  mediaMsgType(att.MimeType),
+		Body:     att.Name,
+		FileName: att.Name,
+		Info:     &event.FileInfo{MimeType: att.MimeType},
+	}
+	if att.Caption != "" {
+		content.Body = att.Caption
+	}
+	if content.MsgType == event.MsgImage {
+		// clients use the size to reserve space before loading the image
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(att.Data)); err == nil {
+			content.Info.Width = cfg.Width
+			content.Info.Height = cfg.Height
+		}
+	}
+
+	if err := ma.uploadFile(ctx, roomID, content, att.Data); err != nil {
+		return err
+	}
+	target.apply(content)
+	_, err := ma.Client.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	return err
+}
+
+func (ma *MatrixAdapter) SendMedia(chatID string, replyToID string, media core.Attachment) error {
+	ctx := context.Background()
+	return ma.sendAttachment(ctx, id.RoomID(chatID), ma.replyTarget(id.EventID(replyToID)), media)
+}
+
+func (ma *MatrixAdapter) SendRich(chatID string, msg *core.OutgoingMessage) error {
+	ctx := context.Background()
+	roomID := id.RoomID(chatID)
+	target := ma.replyTarget(id.EventID(msg.ReplyTo))
+
+	if text := msg.Markdown("!" + ma.Config.Name); text != "" {
+		if err := ma.send(ctx, roomID, target, text); err != nil {
+			return err
+		}
+		// only the first event is sent as a reply
+		target.replyTo = ""
+	}
+
+	// HTML can't reference external images, so upload the card image and
+	// send it as its own event
+	files := msg.Files
+	imageURL := msg.Image
+	if imageURL == "" {
+		imageURL = msg.Thumbnail
+	}
+	if imageURL != "" {
+		att, err := fetchImage(ctx, imageURL)
+		if err != nil {
+			log.Printf("Failed to fetch card image: %v", err)
+		} else {
+			files = append([]core.Attachment{att}, files...)
+		}
+	}
+
+	for _, att := range files {
+		if err := ma.sendAttachment(ctx, roomID, target, att); err != nil {
+			return err
+		}
+		target.replyTo = ""
+	}
+	return nil
+}
+
+// isMedia reports whether content is a file the model may be able to read.
+func isMedia(content *event.MessageEventContent) bool {
+	switch content.MsgType {
+	case event.MsgImage, event.MsgFile, event.MsgAudio:
+		return true
+	default:
+		return false
+	}
+}
+
+// mediaCaption returns the caption of a media message. The body only holds
+// a caption if it differs from the file name; older clients put the file
+// name in the body and leave filename unset.
+func mediaCaption(content *event.MessageEventContent) string {
+	if content.FileName == "" || content.FileName == content.Body {
+		return ""
+	}
+	return content.Body
+}
+
+// downloadMedia downloads and, in encrypted rooms, decrypts the file of a
+// media message. Files over the download limit are refused up front if
+// the sender stated their size, and cut off while downloading otherwise.
+func (ma *MatrixAdapter) downloadMedia(ctx context.Context, content *event.MessageEventContent) ([]byte, error) {
+	limit := ma.MatrixConfig.DownloadLimit()
+	tooLarge := fmt.Errorf("%w, the limit is %d MB", core.ErrAttachmentTooLarge, limit>>20)
+	if info := content.GetInfo(); info != nil && info.Size > limit {
+		return nil, tooLarge
+	}
+
+	uri := content.URL
+	if content.File != nil {
+		uri = content.File.URL
+	}
+	mxc, err := uri.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid file URL %q: %w", uri, err)
+	}
+	if !mxc.IsValid() {
+		return nil, fmt.Errorf("invalid file URL %q", uri)
+	}
+
+	resp, err := ma.Client.Download(ctx, mxc)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > int64(limit) {
+		return nil, tooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	if len(data) > limit {
+		return nil, tooLarge
+	}
+
+	if content.File != nil {
+		if err := content.File.DecryptInPlace(data); err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// checkMediaType makes sure the file's content matches the kind of
+// message it was sent as, so that e.g. an "image" holding HTML is refused.
+func checkMediaType(msgType event.MessageType, mimeType string) error {
+	switch {
+	case msgType == event.MsgImage && !strings.HasPrefix(mimeType, "image/"):
+		return fmt.Errorf("the image is actually %s", mimeType)
+	case msgType == event.MsgAudio && !strings.HasPrefix(mimeType, "audio/"):
+		return fmt.Errorf("the audio file is actually %s", mimeType)
+	}
+	return nil
+}
+
+// addAttachment downloads a media message and adds it to msg if the model
+// supports it. Problems are recorded in msg so the user learns about them.
+func (ma *MatrixAdapter) addAttachment(ctx context.Context, msg *core.IncomingMessage, content *event.MessageEventContent) {
+	att := core.Attachment{Name: content.FileName}
+	if att.Name == "" {
+		att.Name = content.Body
+	}
+	fail := func(err error) {
+		log.Printf("❌ Skipping attachment %s: %v", att.Name, err)
+		msg.AttachmentErrors = append(msg.AttachmentErrors, fmt.Errorf("%s: %w", att.Name, err))
+	}
+
+	data, err := ma.downloadMedia(ctx, content)
+	if err != nil {
+		fail(err)
+		return
+	}
+	att.Data = data
+
+	if info := content.GetInfo(); info != nil {
+		att.MimeType = info.MimeType
+		att.Duration = time.Duration(info.Duration) * time.Millisecond
+	}
+	if err := checkMediaType(content.MsgType, core.SniffMimeType(att.Name, att.MimeType, data)); err != nil {
+		fail(err)
+		return
+	}
+	if err := msg.AddAttachment(att); err != nil {
+		log.Printf("❌ Skipping attachment: %v", err)
+		msg.AttachmentErrors = append(msg.AttachmentErrors, err)
+	}
+}
@@ -0,0 +1,43 @@
+package matrix
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var htmlLink = regexp.MustCompile(`<a\s[^>]*href="([^"]+)"[^>]*>(.*?)</a>`)
+
+// findMention reports whether the message mentions the bot, either in
+// m.mentions or, for older clients, through a pill linking to its user ID.
+// It also returns the pill's text so it can be removed from the body.
+func (ma *MatrixAdapter) findMention(content *event.MessageEventContent) (mentioned bool, pillText string) {
+	if content.Format == event.FormatHTML {
+		for _, link := range htmlLink.FindAllStringSubmatch(content.FormattedBody, -1) {
+			uri, err := id.ParseMatrixURIOrMatrixToURL(html.UnescapeString(link[1]))
+			if err == nil && uri.UserID() == ma.Client.UserID {
+				return true, html.UnescapeString(link[2])
+			}
+		}
+	}
+	return content.Mentions.Has(ma.Client.UserID), ""
+}
+
+// stripMention removes the pill text, as in "Bot: hello", from body along
+// with the punctuation and spaces that set it apart.
+func stripMention(body string, pillText string) string {
+	i := strings.Index(body, pillText)
+	if pillText == "" || i < 0 {
+		return body
+	}
+	before := strings.TrimRight(body[:i], ",; ")
+	after := strings.TrimLeft(body[i+len(pillText):], ":,; ")
+	// "thanks, Bot!" keeps its closing punctuation
+	if before == "" || after == "" || strings.ContainsAny(after[:1], ".!?") {
+		return strings.TrimSpace(before + after)
+	}
+	return before + " " + after
+}
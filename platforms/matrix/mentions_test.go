@@ -0,0 +1,80 @@
+package matrix
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFindMention(t *testing.T) {
+	const botID = id.UserID("@rakka:example.org")
+	tests := []struct {
+		name      string
+		content   event.MessageEventContent
+		mentioned bool
+		pillText  string
+	}{
+		{
+			name:    "plain text",
+			content: event.MessageEventContent{Body: "rakka, hello"},
+		},
+		{
+			name:      "m.mentions",
+			content:   event.MessageEventContent{Body: "hello", Mentions: &event.Mentions{UserIDs: []id.UserID{botID}}},
+			mentioned: true,
+		},
+		{
+			name: "pill",
+			content: event.MessageEventContent{
+				Body:          "Rakka: hello",
+				Format:        event.FormatHTML,
+				FormattedBody: `<a href="https://matrix.to/#/@rakka:example.org">Rakka</a>: hello`,
+			},
+			mentioned: true,
+			pillText:  "Rakka",
+		},
+		{
+			name: "pill for someone else",
+			content: event.MessageEventContent{
+				Body:          "Alice: hello",
+				Format:        event.FormatHTML,
+				FormattedBody: `<a href="https://matrix.to/#/@alice:example.org">Alice</a>: hello`,
+			},
+		},
+		{
+			name:    "m.mentions for someone else",
+			content: event.MessageEventContent{Body: "hello", Mentions: &event.Mentions{UserIDs: []id.UserID{"@alice:example.org"}}},
+		},
+	}
+
+	ma := &MatrixAdapter{Client: &mautrix.Client{UserID: botID}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mentioned, pillText := ma.findMention(&tt.content)
+			if mentioned != tt.mentioned || pillText != tt.pillText {
+				t.Errorf("findMention() = %v, %q, want %v, %q", mentioned, pillText, tt.mentioned, tt.pillText)
+			}
+		})
+	}
+}
+
+func TestStripMention(t *testing.T) {
+	tests := []struct {
+		body, pillText, want string
+	}{
+		{"Rakka: hello", "Rakka", "hello"},
+		{"hey Rakka, how are you", "Rakka", "hey how are you"},
+		{"thanks, Rakka!", "Rakka", "thanks!"},
+		{"can you help, Rakka?", "Rakka", "can you help?"},
+		{"ask Rakka", "Rakka", "ask"},
+		{"hello", "", "hello"},
+		{"Rakka,   what's up", "Rakka", "what's up"},
+	}
+	for _, tt := range tests {
+		if got := stripMention(tt.body, tt.pillText); got != tt.want {
+			t.Errorf("stripMention(%q, %q) = %q, want %q", tt.body, tt.pillText, got, tt.want)
+		}
+	}
+}
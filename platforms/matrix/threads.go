@@ -0,0 +1,65 @@
+package matrix
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxTrackedThreadEvents bounds the event→thread cache. Replies are sent
+// shortly after the message arrives, so only recent events matter.
+const maxTrackedThreadEvents = 1000
+
+// replyTarget says where an outgoing event goes: as a reply to replyTo
+// and, if the original message was in a thread, into that thread.
+type replyTarget struct {
+	replyTo    id.EventID
+	threadRoot id.EventID
+}
+
+func (t replyTarget) apply(content *event.MessageEventContent) {
+	if t.threadRoot != "" {
+		rel := &event.RelatesTo{}
+		if t.replyTo != "" {
+			rel.SetReplyTo(t.replyTo)
+		}
+		// clients without thread support show the fallback as a reply to the root
+		content.RelatesTo = rel.SetThread(t.threadRoot, t.threadRoot)
+		return
+	}
+	if t.replyTo != "" {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(t.replyTo)
+	}
+}
+
+// replyTarget answers eventID in its thread if it was part of one.
+func (ma *MatrixAdapter) replyTarget(eventID id.EventID) replyTarget {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	return replyTarget{replyTo: eventID, threadRoot: ma.threads[eventID]}
+}
+
+func (ma *MatrixAdapter) rememberThread(eventID id.EventID, threadRoot id.EventID) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	if _, ok := ma.threads[eventID]; ok {
+		return
+	}
+	ma.threads[eventID] = threadRoot
+	ma.threadOrder = append(ma.threadOrder, eventID)
+	if len(ma.threadOrder) > maxTrackedThreadEvents {
+		delete(ma.threads, ma.threadOrder[0])
+		ma.threadOrder = ma.threadOrder[1:]
+	}
+}
+
+// removeReplyFallback strips the quote of the replied-to message that
+// clients put in front of replies, so it isn't taken as part of the text.
+// Messages without formatted bodies only carry the plain text quote.
+func removeReplyFallback(content *event.MessageEventContent) {
+	if content.RelatesTo.GetReplyTo() == "" {
+		return
+	}
+	content.RemoveReplyFallback()
+	content.Body = event.TrimReplyFallbackText(content.Body)
+}
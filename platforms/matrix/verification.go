@@ -0,0 +1,258 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/verificationhelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"rakka/core"
+)
+
+type verification struct {
+	userID      id.UserID
+	deviceID    id.DeviceID
+	startedByUs bool
+	sasShown    bool
+}
+
+// verifier runs SAS emoji verification with bot admins. The bot has no
+// screen, so it sends the emoji to the admin in a direct chat and waits for
+// `verify confirm`. Its callbacks may run while the helper holds its lock,
+// so calls back into the helper happen in goroutines.
+type verifier struct {
+	ma     *MatrixAdapter
+	helper *verificationhelper.VerificationHelper
+
+	mu      sync.Mutex
+	pending map[id.VerificationTransactionID]*verification
+}
+
+func (ma *MatrixAdapter) initVerification(ctx context.Context) error {
+	mach, err := cryptoMachine(ma.Client)
+	if err != nil {
+		return nil
+	}
+
+	v := &verifier{ma: ma, pending: make(map[id.VerificationTransactionID]*verification)}
+	v.helper = verificationhelper.NewVerificationHelper(ma.Client, mach, nil, v, false, false, true)
+	if err := v.helper.Init(ctx); err != nil {
+		return fmt.Errorf("failed to init verification: %w", err)
+	}
+
+	ma.verifier = v
+	return nil
+}
+
+var _ core.DeviceVerifier = (*MatrixAdapter)(nil)
+
+func (ma *MatrixAdapter) CanVerify() bool {
+	return ma.verifier != nil
+}
+
+func (ma *MatrixAdapter) VerifyCommand(ctx core.CommandContext) error {
+	return ma.verifier.command(ctx)
+}
+
+func (v *verifier) VerificationRequested(ctx context.Context, txnID id.VerificationTransactionID, from id.UserID, fromDevice id.DeviceID) {
+	if !v.ma.Config.IsAdmin(from.String()) {
+		log.Printf("🔐 Rejecting verification request from %s (not an admin)", from)
+		go v.cancel(txnID, "Only bot admins can verify this device.")
+		return
+	}
+
+	log.Printf("🔐 Accepting verification request from %s (%s)", from, fromDevice)
+	v.mu.Lock()
+	v.pending[txnID] = &verification{userID: from, deviceID: fromDevice}
+	v.mu.Unlock()
+
+	go func() {
+		if err := v.helper.AcceptVerification(context.Background(), txnID); err != nil {
+			log.Printf("Failed to accept verification %s: %v", txnID, err)
+		}
+	}()
+}
+
+// pendingWait is how long callbacks wait for `verify start` to record the
+// transaction it started; a fast client can answer before it returns.
+const pendingWait = 5 * time.Second
+
+// awaitPending applies update to the transaction's entry under the lock and
+// returns a copy of it, or nil if none shows up in time.
+func (v *verifier) awaitPending(txnID id.VerificationTransactionID, update func(*verification)) *verification {
+	deadline := time.Now().Add(pendingWait)
+	for {
+		var copied *verification
+		v.mu.Lock()
+		if ver := v.pending[txnID]; ver != nil {
+			update(ver)
+			snapshot := *ver
+			copied = &snapshot
+		}
+		v.mu.Unlock()
+		if copied != nil || time.Now().After(deadline) {
+			return copied
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (v *verifier) VerificationReady(ctx context.Context, txnID id.VerificationTransactionID, otherDeviceID id.DeviceID, supportsSAS, supportsScanQRCode bool, qrCode *verificationhelper.QRCode) {
+	go func() {
+		ver := v.awaitPending(txnID, func(ver *verification) { ver.deviceID = otherDeviceID })
+		if ver == nil {
+			log.Printf("🔐 Cancelling unknown verification %s", txnID)
+			v.cancel(txnID, "Unknown verification.")
+			return
+		}
+
+		if !supportsSAS {
+			v.cancel(txnID, "Only emoji verification is supported.")
+			return
+		}
+		// when the admin started, their client sends the SAS start
+		if ver.startedByUs {
+			if err := v.helper.StartSAS(context.Background(), txnID); err != nil {
+				log.Printf("Failed to start SAS for %s: %v", txnID, err)
+			}
+		}
+	}()
+}
+
+func (v *verifier) ShowSAS(ctx context.Context, txnID id.VerificationTransactionID, emojis []rune, emojiDescriptions []string, decimals []int) {
+	go v.showSAS(txnID, emojis, emojiDescriptions, decimals)
+}
+
+func (v *verifier) showSAS(txnID id.VerificationTransactionID, emojis []rune, emojiDescriptions []string, decimals []int) {
+	ver := v.awaitPending(txnID, func(ver *verification) { ver.sasShown = true })
+	if ver == nil {
+		log.Printf("🔐 Cancelling unknown verification %s", txnID)
+		v.cancel(txnID, "Unknown verification.")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🔐 Verifying your device %s. Check that your client shows these emoji in this order:\n\n", ver.deviceID))
+	if len(emojis) > 0 {
+		for i, emoji := range emojis {
+			sb.WriteString(fmt.Sprintf("%c %s\n", emoji, emojiDescriptions[i]))
+		}
+	} else {
+		for _, n := range decimals {
+			sb.WriteString(fmt.Sprintf("%d ", n))
+		}
+		sb.WriteString("\n")
+	}
+	prefix := "!" + v.ma.Config.Name
+	sb.WriteString(fmt.Sprintf("\nThen reply `%s verify confirm`, or `%s verify cancel` if they differ.", prefix, prefix))
+	v.notify(ver.userID, sb.String())
+}
+
+func (v *verifier) VerificationCancelled(ctx context.Context, txnID id.VerificationTransactionID, code event.VerificationCancelCode, reason string) {
+	ver := v.finish(txnID)
+	log.Printf("🔐 Verification %s cancelled: %s (%s)", txnID, reason, code)
+	if ver != nil && ver.sasShown {
+		go v.notify(ver.userID, "❌ Verification cancelled: "+reason)
+	}
+}
+
+func (v *verifier) VerificationDone(ctx context.Context, txnID id.VerificationTransactionID, method event.VerificationMethod) {
+	ver := v.finish(txnID)
+	if ver == nil {
+		return
+	}
+	log.Printf("🔐 Verified %s (%s)", ver.userID, ver.deviceID)
+	go v.notify(ver.userID, fmt.Sprintf("✅ Verified device %s. We now trust each other's cross-signing keys.", ver.deviceID))
+}
+
+func (v *verifier) finish(txnID id.VerificationTransactionID) *verification {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ver := v.pending[txnID]
+	delete(v.pending, txnID)
+	return ver
+}
+
+// forUser returns the user's most relevant transaction, preferring one
+// whose emoji have been shown.
+func (v *verifier) forUser(userID id.UserID) (id.VerificationTransactionID, *verification) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var found id.VerificationTransactionID
+	for txnID, ver := range v.pending {
+		if ver.userID != userID {
+			continue
+		}
+		if ver.sasShown {
+			return txnID, ver
+		}
+		found = txnID
+	}
+	return found, v.pending[found]
+}
+
+func (v *verifier) cancel(txnID id.VerificationTransactionID, reason string) {
+	if err := v.helper.CancelVerification(context.Background(), txnID, event.VerificationCancelCodeUser, reason); err != nil {
+		log.Printf("Failed to cancel verification %s: %v", txnID, err)
+	}
+}
+
+func (v *verifier) notify(userID id.UserID, text string) {
+	roomID, err := v.ma.OpenDirectChat(userID.String())
+	if err != nil {
+		log.Printf("Failed to open direct chat with %s: %v", userID, err)
+		return
+	}
+	if err := v.ma.SendText(roomID, text); err != nil {
+		log.Printf("Failed to send verification message to %s: %v", userID, err)
+	}
+}
+
+func (v *verifier) command(ctx core.CommandContext) error {
+	userID := id.UserID(ctx.Msg.UserID)
+
+	action := "start"
+	if len(ctx.Args) > 0 {
+		action = strings.ToLower(ctx.Args[0])
+	}
+
+	switch action {
+	case "start":
+		txnID, err := v.helper.StartVerification(context.Background(), userID)
+		if err != nil {
+			return err
+		}
+		v.mu.Lock()
+		v.pending[txnID] = &verification{userID: userID, startedByUs: true}
+		v.mu.Unlock()
+		return ctx.Reply("📨 Sent a verification request to your devices. Accept it and I'll send you the emoji to compare.")
+
+	case "confirm":
+		txnID, ver := v.forUser(userID)
+		if ver == nil || !ver.sasShown {
+			return ctx.Reply("There is no verification waiting for confirmation.")
+		}
+		if err := v.helper.ConfirmSAS(context.Background(), txnID); err != nil {
+			return err
+		}
+		return ctx.Reply("👍 Confirmed. Confirm in your client too if you haven't yet.")
+
+	case "cancel":
+		txnID, ver := v.forUser(userID)
+		if ver == nil {
+			return ctx.Reply("There is no verification in progress.")
+		}
+		v.cancel(txnID, "Cancelled by the admin.")
+		return ctx.Reply("Verification cancelled.")
+
+	default:
+		return ctx.Reply("Usage: `verify [start|confirm|cancel]`")
+	}
+}